@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/gob"
 	"html/template"
+	"mime"
+	"net/url"
+	"path"
 )
 
 // https://developers.google.com/+/api/latest/activities/list#response
@@ -22,17 +25,39 @@ type Activity struct {
 	Id        string `json:"id"`
 	Url       string `json:"url"`
 	Verb      string `json:"verb"`
+	Actor     Actor  `json:"actor"`
 	Object    Object `json:"object"`
 
 	// used in blogplus
+	Slug             string // assigned when stored first, never changes
 	FormedAttachment string
 	Permalink        string
+	AuthorPermalink  string
+	TagLinks         []TagLink
+	Override         Override
+	Mentions         []Mention    // approved Webmentions, set for the post page
+	Source           *EntrySource // set for posts created by Micropub
+	Listed           bool         // shown in a list page, with the excerpt of the content
 }
 
+type TagLink struct {
+	Tag string
+	Url string
+}
+
+// HTMLFormedAttachment returns FormedAttachment, rendered from
+// sanitized attachments by the attachment templates.
 func (a Activity) HTMLFormedAttachment() template.HTML {
 	return template.HTML(a.FormedAttachment)
 }
 
+type Actor struct {
+	Id          string `json:"id"`
+	DisplayName string `json:"displayName"`
+	Url         string `json:"url"`
+	Image       Image  `json:"image"`
+}
+
 type Object struct {
 	Content     string       `json:"content"`
 	Attachments []Attachment `json:"attachments"`
@@ -41,11 +66,17 @@ type Object struct {
 	Resharers   Counter      `json:"resharers"`
 
 	// used in blogplus
-	Subject string
+	SanitizedContent string // Content sanitized by PreparePost
+	Subject          string
+	Excerpt          string // plain text
+	ContentExcerpt   string // HTML shown in list pages, if Truncated
+	Truncated        bool
+	Tags             []string
 }
 
+// HTMLContent returns Content, sanitized by PreparePost.
 func (o Object) HTMLContent() template.HTML {
-	return template.HTML(o.Content)
+	return template.HTML(o.SanitizedContent)
 }
 
 type Attachment struct {
@@ -55,16 +86,56 @@ type Attachment struct {
 	Content     string `json:"content"`
 	Url         string `json:"url"`
 	Image       Image  `json:"image"`
+
+	// used in blogplus
+	SanitizedDisplayName string // DisplayName sanitized by PreparePost
 }
 
+// HTMLContentExcerpt returns ContentExcerpt, or Content if it is not truncated.
+func (o Object) HTMLContentExcerpt() template.HTML {
+	if !o.Truncated {
+		return template.HTML(o.SanitizedContent)
+	}
+	return template.HTML(o.ContentExcerpt)
+}
+
+// HTMLDisplayName returns DisplayName, sanitized by PreparePost.
 func (a Attachment) HTMLDisplayName() template.HTML {
-	return template.HTML(a.DisplayName)
+	return template.HTML(a.SanitizedDisplayName)
 }
 
 type Image struct {
 	Url string `json:"url"`
 }
 
+// Enclosure is a media file of a post, used in feeds.
+type Enclosure struct {
+	Url  string
+	Type string
+}
+
+// Enclosures returns images of photo and video attachments.
+// for videos, it is the preview image, since Url is a page to play it.
+func (a Activity) Enclosures() []Enclosure {
+	var enclosures []Enclosure
+	for _, attachment := range a.Object.Attachments {
+		if attachment.ObjectType != "photo" && attachment.ObjectType != "video" {
+			continue
+		}
+		if attachment.Image.Url == "" {
+			continue
+		}
+		typ := "image/jpeg"
+		if u, err := url.Parse(attachment.Image.Url); err == nil {
+			if t := mime.TypeByExtension(path.Ext(u.Path)); t != "" {
+				typ = t
+			}
+		}
+		enclosures = append(enclosures, Enclosure{Url: attachment.Image.Url, Type: typ})
+	}
+	return enclosures
+}
+
 type Counter struct {
 	TotalItems int `json:"totalItems"`
 }
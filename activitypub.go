@@ -0,0 +1,564 @@
+package blogplus
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ActivityPub: https://www.w3.org/TR/activitypub/
+
+const (
+	webfingerPath = "/.well-known/webfinger"
+	actorPath     = "/actor"
+	inboxPath     = "/actor/inbox"
+	outboxPath    = "/actor/outbox"
+	followersPath = "/actor/followers"
+
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	securityContext        = "https://w3id.org/security/v1"
+	publicCollection       = "https://www.w3.org/ns/activitystreams#Public"
+	activityJSONType       = "application/activity+json"
+
+	maxOutboxItems = 20
+	actorKeyBits   = 2048
+)
+
+// activityPubClient fetches actors and delivers to inboxes given by others.
+var activityPubClient = newPublicClient()
+
+// Follower is an ActivityPub actor following the blog.
+type Follower struct {
+	Id       string // actor id
+	Inbox    string // shared inbox if any
+	Followed string // RFC3339 timestamp
+}
+
+type APActor struct {
+	Context           interface{}  `json:"@context,omitempty"`
+	Id                string       `json:"id"`
+	Type              string       `json:"type"`
+	PreferredUsername string       `json:"preferredUsername,omitempty"`
+	Name              string       `json:"name,omitempty"`
+	Url               string       `json:"url,omitempty"`
+	Icon              *APDocument  `json:"icon,omitempty"`
+	Inbox             string       `json:"inbox"`
+	Outbox            string       `json:"outbox,omitempty"`
+	Followers         string       `json:"followers,omitempty"`
+	Endpoints         *APEndpoints `json:"endpoints,omitempty"`
+	PublicKey         APPublicKey  `json:"publicKey"`
+}
+
+type APEndpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+type APPublicKey struct {
+	Id           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type APDocument struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType,omitempty"`
+	Url       string `json:"url"`
+}
+
+type APTag struct {
+	Type string `json:"type"`
+	Href string `json:"href"`
+	Name string `json:"name"`
+}
+
+type APNote struct {
+	Context      interface{}  `json:"@context,omitempty"`
+	Id           string       `json:"id"`
+	Type         string       `json:"type"`
+	AttributedTo string       `json:"attributedTo"`
+	Content      string       `json:"content"`
+	Url          string       `json:"url"`
+	Published    string       `json:"published"`
+	Updated      string       `json:"updated,omitempty"`
+	To           []string     `json:"to"`
+	Cc           []string     `json:"cc"`
+	Tag          []APTag      `json:"tag,omitempty"`
+	Attachment   []APDocument `json:"attachment,omitempty"`
+}
+
+type APActivity struct {
+	Context   interface{} `json:"@context,omitempty"`
+	Id        string      `json:"id"`
+	Type      string      `json:"type"`
+	Actor     string      `json:"actor"`
+	Object    interface{} `json:"object"`
+	Published string      `json:"published,omitempty"`
+	To        []string    `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+}
+
+type APTombstone struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type APCollection struct {
+	Context      interface{}  `json:"@context,omitempty"`
+	Id           string       `json:"id"`
+	Type         string       `json:"type"`
+	TotalItems   int          `json:"totalItems"`
+	OrderedItems []APActivity `json:"orderedItems,omitempty"`
+}
+
+// apIncoming is an activity received in the inbox.
+type apIncoming struct {
+	Id     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+// objectId returns the id of object, which may be an id or an object.
+func objectId(object json.RawMessage) (id, typ string) {
+	if err := json.Unmarshal(object, &id); err == nil {
+		return id, ""
+	}
+	var o struct {
+		Id   string `json:"id"`
+		Type string `json:"type"`
+	}
+	json.Unmarshal(object, &o)
+	return o.Id, o.Type
+}
+
+type webfingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+type webfinger struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []webfingerLink `json:"links"`
+}
+
+// LoadActorKey loads the RSA private key of the actor from filename
+// in PEM, or creates a new key in filename if it doesn't exist.
+func LoadActorKey(filename string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		key, err := rsa.GenerateKey(rand.Reader, actorKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		log.Println("create actor key:", filename)
+		return key, ioutil.WriteFile(filename, data, os.FileMode(0600))
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", filename)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// EnableActivityPub publishes the blog as an ActivityPub actor
+// @name@host, signing with key.
+func (b *Blogplus) EnableActivityPub(name string, key *rsa.PrivateKey) {
+	b.ActorName = name
+	b.actorKey = key
+}
+
+func (b *Blogplus) actorId(serverRoot *url.URL) string {
+	return serverRoot.String() + actorPath
+}
+
+func (b *Blogplus) actorKeyId(serverRoot *url.URL) string {
+	return b.actorId(serverRoot) + "#main-key"
+}
+
+func serveActivityJSON(w http.ResponseWriter, contentType string, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("activitypub write error:", err)
+	}
+}
+
+// wantsActivityJSON reports whether req asks for ActivityPub objects.
+func wantsActivityJSON(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, activityJSONType) || strings.Contains(accept, "application/ld+json")
+}
+
+// ServeWebfinger serves /.well-known/webfinger?resource=acct:{name}@{host}.
+// Since clients look it up at the root of the host, it is routed there
+// as well as under b.Prefix; if b only handles paths under b.Prefix,
+// a proxy must pass /.well-known/webfinger to it.
+func (b *Blogplus) ServeWebfinger(w http.ResponseWriter, req *http.Request) {
+	if b.actorKey == nil {
+		http.NotFound(w, req)
+		return
+	}
+	serverRoot := getServerRoot(b, req)
+	actor := b.actorId(serverRoot)
+	subject := "acct:" + b.ActorName + "@" + serverRoot.Host
+	if resource := req.FormValue("resource"); resource != subject && resource != actor {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	serveActivityJSON(w, "application/jrd+json", webfinger{
+		Subject: subject,
+		Aliases: []string{actor, serverRoot.String()},
+		Links: []webfingerLink{
+			{Rel: "self", Type: activityJSONType, Href: actor},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: serverRoot.String()}}})
+}
+
+// ServeActor serves the actor document and its collections.
+func (b *Blogplus) ServeActor(w http.ResponseWriter, req *http.Request) {
+	if b.actorKey == nil {
+		http.NotFound(w, req)
+		return
+	}
+	serverRoot := getServerRoot(b, req)
+	actor := b.actorId(serverRoot)
+	switch strings.TrimPrefix(req.URL.Path, b.Prefix) {
+	case actorPath:
+		der, err := x509.MarshalPKIXPublicKey(&b.actorKey.PublicKey)
+		if err != nil {
+			log.Println("actor key:", err)
+			http.Error(w, "actor key error", http.StatusInternalServerError)
+			return
+		}
+		a := APActor{
+			Context:           []string{activityStreamsContext, securityContext},
+			Id:                actor,
+			Type:              "Person",
+			PreferredUsername: b.ActorName,
+			Name:              b.Title,
+			Url:               serverRoot.String(),
+			Inbox:             serverRoot.String() + inboxPath,
+			Outbox:            serverRoot.String() + outboxPath,
+			Followers:         serverRoot.String() + followersPath,
+			PublicKey: APPublicKey{
+				Id:           b.actorKeyId(serverRoot),
+				Owner:        actor,
+				PublicKeyPem: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))}}
+		if b.LogoUrl != "" {
+			a.Icon = &APDocument{Type: "Image", Url: b.LogoUrl}
+		}
+		serveActivityJSON(w, activityJSONType, a)
+	case outboxPath:
+		var items []APActivity
+		for _, post := range b.storage.GetPagedPosts(req, 0, maxOutboxItems) {
+			processPost(&post, serverRoot)
+			items = append(items, b.postActivity(post, serverRoot))
+		}
+		serveActivityJSON(w, activityJSONType, APCollection{
+			Context:      activityStreamsContext,
+			Id:           serverRoot.String() + outboxPath,
+			Type:         "OrderedCollection",
+			TotalItems:   b.countPosts(req),
+			OrderedItems: items})
+	case followersPath:
+		// followers are not listed for their privacy.
+		serveActivityJSON(w, activityJSONType, APCollection{
+			Context:    activityStreamsContext,
+			Id:         serverRoot.String() + followersPath,
+			Type:       "OrderedCollection",
+			TotalItems: len(b.storage.GetFollowers(req))})
+	case inboxPath:
+		b.serveInbox(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (b *Blogplus) countPosts(req *http.Request) int {
+	n := 0
+	for _, item := range b.storage.GetDates(req) {
+		n += item.Count
+	}
+	return n
+}
+
+// postNote returns post as a Note. post must be processed by processPost.
+func (b *Blogplus) postNote(post Activity, serverRoot *url.URL) APNote {
+	actor := b.actorId(serverRoot)
+	note := APNote{
+		// same as the atom entry id.
+		Id:           serverRoot.String() + postPath + post.Id,
+		Type:         "Note",
+		AttributedTo: actor,
+		Content:      post.Object.SanitizedContent,
+		Url:          post.Permalink,
+		Published:    post.Published,
+		To:           []string{publicCollection},
+		Cc:           []string{serverRoot.String() + followersPath}}
+	if post.Updated != post.Published {
+		note.Updated = post.Updated
+	}
+	for _, tagLink := range post.TagLinks {
+		note.Tag = append(note.Tag, APTag{Type: "Hashtag", Href: tagLink.Url, Name: "#" + tagLink.Tag})
+	}
+	for _, enclosure := range post.Enclosures() {
+		note.Attachment = append(note.Attachment, APDocument{Type: "Document", MediaType: enclosure.Type, Url: enclosure.Url})
+	}
+	return note
+}
+
+// postActivity returns Create activity of post, or Update if post is updated.
+func (b *Blogplus) postActivity(post Activity, serverRoot *url.URL) APActivity {
+	note := b.postNote(post, serverRoot)
+	activity := APActivity{
+		Id:        note.Id + "#create",
+		Type:      "Create",
+		Actor:     note.AttributedTo,
+		Object:    note,
+		Published: post.Published,
+		To:        note.To,
+		Cc:        note.Cc}
+	if note.Updated != "" {
+		activity.Id = note.Id + "#update-" + note.Updated
+		activity.Type = "Update"
+		activity.Published = note.Updated
+	}
+	return activity
+}
+
+// deleteActivity returns Delete activity of post.
+func (b *Blogplus) deleteActivity(post Activity, serverRoot *url.URL) APActivity {
+	id := serverRoot.String() + postPath + post.Id
+	return APActivity{
+		Id:     id + "#delete",
+		Type:   "Delete",
+		Actor:  b.actorId(serverRoot),
+		Object: APTombstone{Id: id, Type: "Tombstone"},
+		To:     []string{publicCollection},
+		Cc:     []string{serverRoot.String() + followersPath}}
+}
+
+// serveNote serves post as a Note, for ActivityPub servers
+// dereferencing the post id.
+func (b *Blogplus) serveNote(w http.ResponseWriter, req *http.Request, post Activity) {
+	serverRoot := getServerRoot(b, req)
+	processPost(&post, serverRoot)
+	note := b.postNote(post, serverRoot)
+	note.Context = activityStreamsContext
+	serveActivityJSON(w, activityJSONType, note)
+}
+
+// fetchActor fetches the actor document of id.
+func (b *Blogplus) fetchActor(id string, serverRoot *url.URL) (APActor, error) {
+	var actor APActor
+	req, err := http.NewRequest("GET", id, nil)
+	if err != nil {
+		return actor, err
+	}
+	req.Header.Set("Accept", activityJSONType)
+	// some servers require signed fetches.
+	err = signRequest(req, nil, b.actorKeyId(serverRoot), b.actorKey)
+	if err != nil {
+		return actor, err
+	}
+	resp, err := activityPubClient.Do(req)
+	if err != nil {
+		return actor, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return actor, fmt.Errorf("fetch %s: %s", id, resp.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxFetchSize)).Decode(&actor)
+	return actor, err
+}
+
+func parsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not RSA key")
+	}
+	return rsaKey, nil
+}
+
+// serveInbox handles Follow and Undo Follow. Other activities are ignored.
+func (b *Blogplus) serveInbox(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxFetchSize))
+	if err != nil {
+		http.Error(w, "read error", http.StatusBadRequest)
+		return
+	}
+	var activity apIncoming
+	err = json.Unmarshal(body, &activity)
+	if err != nil {
+		http.Error(w, "bad activity", http.StatusBadRequest)
+		return
+	}
+	serverRoot := getServerRoot(b, req)
+	var sender APActor
+	// the key must be the one of the actor document at the actor id,
+	// since the document at keyId may claim any id.
+	owner, err := verifyRequest(req, body, func(keyId string) (*rsa.PublicKey, string, error) {
+		if activity.Actor == "" {
+			return nil, "", errors.New("no actor")
+		}
+		sender, err = b.fetchActor(activity.Actor, serverRoot)
+		if err != nil {
+			return nil, "", err
+		}
+		if sender.Id != activity.Actor {
+			return nil, "", fmt.Errorf("actor %s has id %s", activity.Actor, sender.Id)
+		}
+		if sender.PublicKey.Id != keyId {
+			return nil, "", fmt.Errorf("unknown key: %s", keyId)
+		}
+		key, err := parsePublicKey(sender.PublicKey.PublicKeyPem)
+		return key, sender.Id, err
+	})
+	if err != nil || owner != activity.Actor {
+		log.Println("inbox: signature:", activity.Actor, err)
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	switch activity.Type {
+	case "Follow":
+		if id, _ := objectId(activity.Object); id != b.actorId(serverRoot) {
+			http.Error(w, "unknown object", http.StatusBadRequest)
+			return
+		}
+		inbox := sender.Inbox
+		if sender.Endpoints != nil && sender.Endpoints.SharedInbox != "" {
+			inbox = sender.Endpoints.SharedInbox
+		}
+		b.storage.AddFollower(req, Follower{
+			Id:       sender.Id,
+			Inbox:    inbox,
+			Followed: time.Now().UTC().Format(time.RFC3339)})
+		log.Println("inbox: followed by", sender.Id)
+		accept := APActivity{
+			Context: activityStreamsContext,
+			Id:      b.actorId(serverRoot) + "#accept-" + randomToken()[:16],
+			Type:    "Accept",
+			Actor:   b.actorId(serverRoot),
+			Object:  json.RawMessage(body)}
+		go b.deliver(sender.Inbox, accept, serverRoot)
+	case "Undo":
+		if _, typ := objectId(activity.Object); typ == "Follow" {
+			b.storage.RemoveFollower(req, activity.Actor)
+			log.Println("inbox: unfollowed by", activity.Actor)
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// deliver posts activity to inbox, signed by the actor.
+func (b *Blogplus) deliver(inbox string, activity APActivity, serverRoot *url.URL) {
+	data, err := json.Marshal(activity)
+	if err != nil {
+		log.Println("deliver:", err)
+		return
+	}
+	req, err := http.NewRequest("POST", inbox, bytes.NewReader(data))
+	if err != nil {
+		log.Println("deliver:", err)
+		return
+	}
+	req.Header.Set("Content-Type", activityJSONType)
+	err = signRequest(req, data, b.actorKeyId(serverRoot), b.actorKey)
+	if err != nil {
+		log.Println("deliver:", err)
+		return
+	}
+	resp, err := activityPubClient.Do(req)
+	if err != nil {
+		log.Println("deliver:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Println("deliver:", inbox, resp.Status)
+	}
+}
+
+// deliverPosts is a StoreHook to deliver activities of posts to the
+// followers: Create or Update when posts are stored, and Delete when
+// they are hidden. Other changes of overrides, such as pins, and posts
+// older than maxNotifyAge are not delivered.
+func (b *Blogplus) deliverPosts(req *http.Request, posts []Activity, reason StoreReason) {
+	if b.actorKey == nil {
+		return
+	}
+	followers := b.storage.GetFollowers(req)
+	if len(followers) == 0 {
+		return
+	}
+	serverRoot := getServerRoot(b, req)
+	if serverRoot.Host == "" {
+		log.Println("activitypub: unknown host, not delivered")
+		return
+	}
+	inboxes := make(map[string]bool)
+	for _, f := range followers {
+		inboxes[f.Inbox] = true
+	}
+	var activities []APActivity
+	for _, post := range posts {
+		var activity APActivity
+		switch {
+		case reason == StoreOverridden && post.Override.Hidden:
+			activity = b.deleteActivity(post, serverRoot)
+		case reason == StoreChanged && !post.Override.Hidden && isRecent(post):
+			processPost(&post, serverRoot)
+			activity = b.postActivity(post, serverRoot)
+		default:
+			continue
+		}
+		activity.Context = activityStreamsContext
+		activities = append(activities, activity)
+	}
+	if len(activities) == 0 {
+		return
+	}
+	go func() {
+		for _, activity := range activities {
+			for inbox := range inboxes {
+				b.deliver(inbox, activity, serverRoot)
+			}
+		}
+	}()
+}
@@ -0,0 +1,371 @@
+package blogplus
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	adminPath         = "/admin"
+	adminLoginPath    = "/admin/login"
+	adminLogoutPath   = "/admin/logout"
+	adminFetchPath    = "/admin/forcefetch"
+	adminModeratePath = "/admin/moderate"
+	adminMentionPath  = "/admin/mention"
+
+	adminCookie     = "blogplus_admin"
+	adminSessionAge = 24 * time.Hour
+)
+
+// FetchStatus is a status of Controller, shown in admin pages.
+type FetchStatus struct {
+	LastFetch time.Time
+	Fetched   int
+	Err       string
+}
+
+type adminSession struct {
+	csrf    string
+	expires time.Time
+}
+
+type adminSessions struct {
+	mu sync.Mutex
+	m  map[string]adminSession // session id -> session
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *adminSessions) create() (id string, session adminSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]adminSession)
+	}
+	now := time.Now()
+	for id, session := range s.m {
+		if now.After(session.expires) {
+			delete(s.m, id)
+		}
+	}
+	id = randomToken()
+	session = adminSession{csrf: randomToken(), expires: now.Add(adminSessionAge)}
+	s.m[id] = session
+	return id, session
+}
+
+func (s *adminSessions) get(id string) (adminSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.m[id]
+	if !ok || time.Now().After(session.expires) {
+		return session, false
+	}
+	return session, true
+}
+
+func (s *adminSessions) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, id)
+}
+
+// AdminPost is a post shown in admin pages with its filter decision.
+type AdminPost struct {
+	Activity
+	Accepted bool
+	Reason   string
+}
+
+type AdminContext struct {
+	Csrf        string
+	Status      FetchStatus
+	Posts       []AdminPost
+	Mentions    []Mention // pending Webmentions
+	LoginFailed bool
+	*Blogplus
+}
+
+func (b *Blogplus) adminSession(req *http.Request) (adminSession, bool) {
+	cookie, err := req.Cookie(adminCookie)
+	if err != nil {
+		return adminSession{}, false
+	}
+	return b.sessions.get(cookie.Value)
+}
+
+func (b *Blogplus) checkCsrf(req *http.Request, session adminSession) bool {
+	return subtle.ConstantTimeCompare([]byte(req.FormValue("csrf")), []byte(session.csrf)) == 1
+}
+
+// ServeAdmin serves the admin pages under /admin.
+// It is disabled unless AdminPasswordHash is set.
+func (b *Blogplus) ServeAdmin(w http.ResponseWriter, req *http.Request) {
+	if b.AdminPasswordHash == "" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	p := strings.TrimPrefix(req.URL.Path, b.Prefix)
+	if p == adminLoginPath {
+		b.serveAdminLogin(w, req)
+		return
+	}
+	session, ok := b.adminSession(req)
+	if !ok {
+		if p != adminPath && p != adminPath+"/" {
+			http.Redirect(w, req, b.Prefix+adminPath, http.StatusFound)
+			return
+		}
+		b.executeAdmin(w, &AdminContext{Blogplus: b})
+		return
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !b.checkCsrf(req, session) {
+			http.Error(w, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+	}
+	switch p {
+	case adminPath, adminPath + "/":
+		b.serveAdminMain(w, req, session)
+	case adminLogoutPath:
+		b.serveAdminLogout(w, req)
+	case adminFetchPath:
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b.c.ForceFetch(req)
+		http.Redirect(w, req, b.Prefix+adminPath, http.StatusSeeOther)
+	case adminModeratePath:
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b.serveAdminModerate(w, req)
+	case adminMentionPath:
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b.serveAdminMention(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (b *Blogplus) serveAdminLogin(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Redirect(w, req, b.Prefix+adminPath, http.StatusFound)
+		return
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(b.AdminPasswordHash), []byte(req.FormValue("password")))
+	if err != nil {
+		log.Println("admin login failed:", req.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		b.executeAdmin(w, &AdminContext{LoginFailed: true, Blogplus: b})
+		return
+	}
+	id, _ := b.sessions.create()
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookie,
+		Value:    id,
+		Path:     b.Prefix + adminPath,
+		MaxAge:   int(adminSessionAge / time.Second),
+		Secure:   b.Scheme == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode})
+	http.Redirect(w, req, b.Prefix+adminPath, http.StatusSeeOther)
+}
+
+func (b *Blogplus) serveAdminLogout(w http.ResponseWriter, req *http.Request) {
+	if cookie, err := req.Cookie(adminCookie); err == nil {
+		b.sessions.remove(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   adminCookie,
+		Path:   b.Prefix + adminPath,
+		MaxAge: -1})
+	http.Redirect(w, req, b.Prefix+adminPath, http.StatusSeeOther)
+}
+
+func (b *Blogplus) serveAdminMain(w http.ResponseWriter, req *http.Request, session adminSession) {
+	rules := b.Filter
+	if rules == nil {
+		rules = &DefaultFilterRules
+	}
+	posts := GetStoredPosts(b.storage, req)
+	serverRoot := getServerRoot(b, req)
+	var adminPosts []AdminPost
+	for _, post := range posts {
+		processPost(&post, serverRoot)
+		ok, reason := rules.Explain(post)
+		adminPosts = append(adminPosts, AdminPost{Activity: post, Accepted: ok, Reason: reason})
+	}
+	b.executeAdmin(w, &AdminContext{
+		Csrf:     session.csrf,
+		Status:   b.c.Status(req),
+		Posts:    adminPosts,
+		Mentions: b.storage.GetPendingMentions(req),
+		Blogplus: b})
+}
+
+func (b *Blogplus) serveAdminModerate(w http.ResponseWriter, req *http.Request) {
+	activityId := req.FormValue("id")
+	post, found := b.storage.GetPost(req, activityId)
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+	o := post.Override
+	switch req.FormValue("action") {
+	case "hide":
+		o.Hidden = true
+	case "unhide":
+		o.Hidden = false
+	case "pin":
+		o.Pinned = true
+	case "unpin":
+		o.Pinned = false
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	err := b.storage.SetOverride(req, activityId, o)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Redirect(w, req, b.Prefix+adminPath, http.StatusSeeOther)
+}
+
+func (b *Blogplus) serveAdminMention(w http.ResponseWriter, req *http.Request) {
+	source, activityId := req.FormValue("source"), req.FormValue("id")
+	var mention *Mention
+	for _, m := range b.storage.GetMentions(req, activityId) {
+		if m.Source == source {
+			mention = &m
+			break
+		}
+	}
+	if mention == nil {
+		http.NotFound(w, req)
+		return
+	}
+	switch req.FormValue("action") {
+	case "approve":
+		mention.Approved = true
+		b.storage.StoreMention(req, *mention)
+	case "delete":
+		b.storage.DeleteMention(req, source, activityId)
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	b.cache.flush()
+	http.Redirect(w, req, b.Prefix+adminPath, http.StatusSeeOther)
+}
+
+func (b *Blogplus) executeAdmin(w http.ResponseWriter, ac *AdminContext) {
+	err := AdminTempl.Execute(w, ac)
+	if err != nil {
+		log.Println("template error:", err)
+	}
+}
+
+var AdminTempl = template.Must(template.New("admin").Parse(adminTempl))
+
+const adminTempl = `<!DOCTYPE html>
+<html>
+ <head>
+  <title>{{.Blogplus.Title}} admin</title>
+  <meta name="robots" content="noindex">
+ </head>
+ <body>
+  <h1>{{.Blogplus.Title}} admin</h1>
+  {{if not .Csrf}}
+  {{if .LoginFailed}}<p class="error">login failed</p>{{end}}
+  <form method="POST" action="{{.Blogplus.Prefix}}` + adminLoginPath + `">
+   <input type="password" name="password" autofocus>
+   <input type="submit" value="login">
+  </form>
+  {{else}}
+  <form method="POST" action="{{.Blogplus.Prefix}}` + adminLogoutPath + `">
+   <input type="hidden" name="csrf" value="{{.Csrf}}">
+   <input type="submit" value="logout">
+  </form>
+  <h2>Fetch</h2>
+  <p>last fetch: {{if .Status.LastFetch.IsZero}}never{{else}}{{.Status.LastFetch.Format "2006-01-02 15:04:05 MST"}}, {{.Status.Fetched}} posts{{end}}
+  {{if .Status.Err}}<br>error: {{.Status.Err}}{{end}}</p>
+  <form method="POST" action="{{.Blogplus.Prefix}}` + adminFetchPath + `">
+   <input type="hidden" name="csrf" value="{{.Csrf}}">
+   <input type="submit" value="force fetch">
+  </form>
+  <h2>Posts</h2>
+  <table>
+   <tr><th>published</th><th>subject</th><th>filter</th><th>status</th><th></th></tr>
+   {{range .Posts}}
+   <tr>
+    <td>{{.Published}}</td>
+    <td><a href="{{.Permalink}}">{{.Object.Subject}}</a></td>
+    <td>{{if .Accepted}}accept{{else}}drop: {{.Reason}}{{end}}</td>
+    <td>{{if .Override.Hidden}}hidden{{end}} {{if .Override.Pinned}}pinned{{end}}</td>
+    <td>
+     <form method="POST" action="{{$.Blogplus.Prefix}}` + adminModeratePath + `">
+      <input type="hidden" name="csrf" value="{{$.Csrf}}">
+      <input type="hidden" name="id" value="{{.Id}}">
+      {{if .Override.Hidden}}<button name="action" value="unhide">unhide</button>{{else}}<button name="action" value="hide">hide</button>{{end}}
+      {{if .Override.Pinned}}<button name="action" value="unpin">unpin</button>{{else}}<button name="action" value="pin">pin</button>{{end}}
+     </form>
+    </td>
+   </tr>
+   {{end}}
+  </table>
+  {{if .Mentions}}
+  <h2>Pending mentions</h2>
+  <table>
+   <tr><th>received</th><th>source</th><th>target</th><th></th></tr>
+   {{range .Mentions}}
+   <tr>
+    <td>{{.Received}}</td>
+    <td><a href="{{.Source}}">{{if .Title}}{{.Title}}{{else}}{{.Source}}{{end}}</a></td>
+    <td><a href="{{.Target}}">{{.Target}}</a></td>
+    <td>
+     <form method="POST" action="{{$.Blogplus.Prefix}}` + adminMentionPath + `">
+      <input type="hidden" name="csrf" value="{{$.Csrf}}">
+      <input type="hidden" name="source" value="{{.Source}}">
+      <input type="hidden" name="id" value="{{.PostId}}">
+      <button name="action" value="approve">approve</button>
+      <button name="action" value="delete">delete</button>
+     </form>
+    </td>
+   </tr>
+   {{end}}
+  </table>
+  {{end}}
+  {{end}}
+ </body>
+</html>
+`
@@ -5,32 +5,43 @@ import (
 )
 
 type AtomFeed struct {
-	XMLName    xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
-	Id         string   `xml:"id"`
-	Title      string   `xml:"title"`
-	Link       []AtomLink
-	Updated    string `xml:"updated"`
-	AuthorName string `xml:"author>name"`
-	AuthorUri  string `xml:"author>uri"`
-	Logo       string `xml:"logo"`
-	Entries    []AtomEntry
+	XMLName  xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+	Base     string   `xml:"http://www.w3.org/XML/1998/namespace base,attr,omitempty"`
+	Id       string   `xml:"id"`
+	Title    string   `xml:"title"`
+	Link     []AtomLink
+	Updated  string `xml:"updated"`
+	Author   *AtomAuthor
+	Logo     string    `xml:"logo,omitempty"`
+	Complete *struct{} `xml:"http://purl.org/syndication/history/1.0 complete"`
+	Entries  []AtomEntry
 }
 
 type AtomLink struct {
 	XMLName xml.Name `xml:"link"`
 	Href    string   `xml:"href,attr"`
 	Rel     string   `xml:"rel,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Title   string   `xml:"title,attr,omitempty"`
 }
 
 type AtomEntry struct {
-	XMLName   xml.Name `xml:"entry"`
-	Id        string   `xml:"id"`
-	Link      AtomLink
-	Title     string `xml:"title"`
-	Content   AtomContent
-	Summary   string `xml:"summary"`
-	Published string `xml:"published"`
-	Updated   string `xml:"updated"`
+	XMLName    xml.Name `xml:"entry"`
+	Id         string   `xml:"id"`
+	Link       []AtomLink
+	Title      string `xml:"title"`
+	Content    AtomContent
+	Summary    AtomText `xml:"summary"`
+	Published  string   `xml:"published"`
+	Updated    string   `xml:"updated"`
+	Author     *AtomAuthor
+	Categories []AtomCategory
+}
+
+type AtomAuthor struct {
+	XMLName xml.Name `xml:"author"`
+	Name    string   `xml:"name"`
+	Uri     string   `xml:"uri,omitempty"`
 }
 
 type AtomContent struct {
@@ -38,3 +49,15 @@ type AtomContent struct {
 	Content string   `xml:",chardata"`
 	Type    string   `xml:"type,attr"`
 }
+
+type AtomText struct {
+	Text string `xml:",chardata"`
+	Type string `xml:"type,attr"`
+}
+
+type AtomCategory struct {
+	XMLName xml.Name `xml:"category"`
+	Term    string   `xml:"term,attr"`
+	Scheme  string   `xml:"scheme,attr,omitempty"`
+	Label   string   `xml:"label,attr,omitempty"`
+}
@@ -0,0 +1,222 @@
+package blogplus
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// buildManifest lists the files written by the last Build in the dir.
+const buildManifest = ".blogplus-build"
+
+// BuildResult reports what Build did.
+type BuildResult struct {
+	Written   int // files created or updated
+	Unchanged int // files already up to date
+	Removed   int // files of the last build no longer built
+
+	files map[string]bool // files written or unchanged
+}
+
+var redirectHTML = template.Must(template.New("redirect").Parse(`<!DOCTYPE html>
+<html>
+ <head>
+  <meta charset="utf-8">
+  <link rel="canonical" href="{{.}}">
+  <meta http-equiv="refresh" content="0; url={{.}}">
+ </head>
+ <body><a href="{{.}}">{{.}}</a></body>
+</html>
+`))
+
+// Build renders the whole blog into dir as static files, using the same
+// handlers as ServeHTTP. b.Scheme and b.Host must be set, since the urls
+// in pages are absolute. HTML pages are written as path/index.html, and
+// others such as feeds are written as path. Files are rewritten only if
+// their content changes, so Build can be run repeatedly on the same dir.
+// Files written by the last Build but not by this one, such as pages of
+// posts hidden since then, are removed; the files are listed in
+// .blogplus-build in dir. Other files in dir are always kept, so nothing
+// is removed by the first Build into a dir.
+// b's Controller should not fetch, since it is called for every page.
+func (b *Blogplus) Build(dir string) (BuildResult, error) {
+	result := BuildResult{files: make(map[string]bool)}
+	var req *http.Request
+	serverRoot := getServerRoot(b, req)
+
+	paths := []string{mainPath, atomFeedPath, rssFeedPath, jsonFeedPath, fullFeedPath, archivesJsPath, sitemapPath, robotsPath}
+	for page := 2; page <= b.feedLastPage(req); page++ {
+		paths = append(paths, feedPagePath+strconv.Itoa(page))
+	}
+	years := make(map[string]bool)
+	for _, item := range b.storage.GetDates(req) {
+		paths = append(paths, archivePath+item.Datespec, archivePath+item.Datespec+atomFeedPath, sitemapMonthPath(item.Datespec))
+		year := strings.SplitN(item.Datespec, "-", 2)[0]
+		if !years[year] {
+			years[year] = true
+			paths = append(paths, archivePath+year, archivePath+year+atomFeedPath)
+		}
+	}
+	authors := make(map[string]bool)
+	for _, post := range GetAllPosts(b.storage, req) {
+		processPost(&post, serverRoot)
+		u, err := url.Parse(post.Permalink)
+		if err != nil {
+			return result, err
+		}
+		paths = append(paths, strings.TrimPrefix(u.Path, b.Prefix))
+		if post.CurrentSlug() != "" {
+			// redirect from the id-based url.
+			paths = append(paths, postPath+post.Id)
+		}
+		if post.Actor.Id != "" && !authors[post.Actor.Id] {
+			authors[post.Actor.Id] = true
+			paths = append(paths, authorPath+post.Actor.Id, authorPath+post.Actor.Id+atomFeedPath)
+		}
+	}
+	for _, item := range b.storage.GetTags(req) {
+		paths = append(paths, tagPath+item.Tag, tagPath+item.Tag+atomFeedPath)
+	}
+	for name := range b.templates().assets {
+		paths = append(paths, themePath+name)
+	}
+
+	for _, p := range paths {
+		data, isHTML, err := b.render(p)
+		if err != nil {
+			return result, err
+		}
+		filename := filepath.Join(dir, filepath.FromSlash(p))
+		if isHTML {
+			filename = filepath.Join(filename, "index.html")
+		}
+		err = writeIfChanged(filename, data, &result)
+		if err != nil {
+			return result, err
+		}
+	}
+	if b.staticDir != "" {
+		err := copyDir(filepath.Join(dir, filepath.FromSlash(b.staticDir)), strings.TrimPrefix(b.staticDir, "/"), &result)
+		if err != nil {
+			return result, err
+		}
+	}
+	if b.MediaDir != "" {
+		err := copyDir(filepath.Join(dir, filepath.FromSlash(mediaPath)), b.MediaDir, &result)
+		if err != nil {
+			return result, err
+		}
+	}
+	err := removeStale(dir, &result)
+	return result, err
+}
+
+// removeStale removes files listed in the manifest of dir but not built
+// this time, and writes the new manifest.
+func removeStale(dir string, result *BuildResult) error {
+	manifest := filepath.Join(dir, buildManifest)
+	old, err := lastBuiltFiles(manifest)
+	if err != nil {
+		return err
+	}
+	root := filepath.Clean(dir) + string(filepath.Separator)
+	for _, rel := range old {
+		filename := filepath.Join(dir, filepath.FromSlash(rel))
+		if rel == "" || result.files[filename] || !strings.HasPrefix(filename, root) {
+			continue
+		}
+		err = os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Println("build: removed", filename)
+		result.Removed++
+		// directories left empty, e.g. of path/index.html.
+		for d := filepath.Dir(filename); strings.HasPrefix(d, root) && os.Remove(d) == nil; d = filepath.Dir(d) {
+		}
+	}
+	var files []string
+	for filename := range result.files {
+		rel, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+	}
+	sort.Strings(files)
+	return ioutil.WriteFile(manifest, []byte(strings.Join(files, "\n")+"\n"), os.FileMode(0644))
+}
+
+// lastBuiltFiles returns the files in manifest, relative to its dir,
+// or nil if manifest doesn't exist.
+func lastBuiltFiles(manifest string) ([]string, error) {
+	data, err := ioutil.ReadFile(manifest)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(data), "\n"), nil
+}
+
+// render returns the response of p, relative to b.Prefix.
+func (b *Blogplus) render(p string) (data []byte, isHTML bool, err error) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.URL.Path = b.Prefix + p
+	req.RequestURI = req.URL.RequestURI()
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, req)
+	switch w.Code {
+	case http.StatusOK:
+		isHTML = strings.HasPrefix(w.Header().Get("Content-Type"), "text/html")
+		return w.Body.Bytes(), isHTML, nil
+	case http.StatusMovedPermanently, http.StatusFound:
+		var buf bytes.Buffer
+		err = redirectHTML.Execute(&buf, w.Header().Get("Location"))
+		return buf.Bytes(), true, err
+	}
+	return nil, false, fmt.Errorf("build %s: status %d", p, w.Code)
+}
+
+func writeIfChanged(filename string, data []byte, result *BuildResult) error {
+	result.files[filename] = true
+	if old, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(old, data) {
+		result.Unchanged++
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(filename), os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	log.Println("build:", filename)
+	result.Written++
+	return ioutil.WriteFile(filename, data, os.FileMode(0644))
+}
+
+func copyDir(dst, src string, result *BuildResult) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return writeIfChanged(filepath.Join(dst, rel), data, result)
+	})
+}
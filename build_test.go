@@ -0,0 +1,49 @@
+package blogplus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildRemovesOnlyBuiltFiles(t *testing.T) {
+	b, s := newTestBlogplus()
+	s.StorePosts(nil, []Activity{testPost("bt1", time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC), "Built post.")})
+	dir := t.TempDir()
+	own := filepath.Join(dir, "post", "mine.html")
+	if err := os.MkdirAll(filepath.Dir(own), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(own, []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Build(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(own); err != nil {
+		t.Errorf("the first build removed a file it didn't write: %v", err)
+	}
+	postPage := filepath.Join(dir, "2020", "01", "built-post", "index.html")
+	if _, err := os.Stat(postPage); err != nil {
+		t.Fatalf("post page not built: %v", err)
+	}
+
+	if err := s.SetOverride(nil, "bt1", Override{Hidden: true}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := b.Build(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(postPage); !os.IsNotExist(err) {
+		t.Errorf("page of the hidden post is kept: %v", err)
+	}
+	if result.Removed == 0 {
+		t.Errorf("Removed = 0")
+	}
+	if _, err := os.Stat(own); err != nil {
+		t.Errorf("the second build removed a file it didn't write: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+package blogplus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// maxCachedPages limits the number of cached pages.
+	// the cache is flushed when it gets full.
+	maxCachedPages = 1000
+
+	// cacheTTL limits how long a page is cached, since posts may be
+	// changed by other processes, such as moderate and reprocess
+	// commands, without StoreHook of this process.
+	cacheTTL = time.Minute
+)
+
+// cachedParams are the query parameters read by handlers of cacheable
+// pages, i.e. resource of WebFinger. Others are not part of the cache key,
+// so that arbitrary queries don't fill the cache.
+var cachedParams = []string{"resource"}
+
+type cachedPage struct {
+	header       http.Header
+	body         []byte
+	gzipped      []byte
+	brotli       []byte
+	etag         string
+	lastModified time.Time
+	cached       time.Time
+}
+
+// pageCache caches rendered pages by url.
+// Since every page has the archive list and the tag cloud in its sidebar,
+// any change of posts invalidates all pages.
+type pageCache struct {
+	mu sync.Mutex
+	m  map[string]*cachedPage
+}
+
+func (c *pageCache) get(key string) *cachedPage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	page := c.m[key]
+	if page != nil && time.Since(page.cached) > cacheTTL {
+		delete(c.m, key)
+		return nil
+	}
+	return page
+}
+
+func (c *pageCache) put(key string, page *cachedPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil || len(c.m) >= maxCachedPages {
+		c.m = make(map[string]*cachedPage)
+	}
+	c.m[key] = page
+}
+
+func (c *pageCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = nil
+}
+
+func newCachedPage(rec *httptest.ResponseRecorder) *cachedPage {
+	page := &cachedPage{
+		header: rec.Header(),
+		body:   rec.Body.Bytes(),
+		cached: time.Now()}
+	sum := sha1.Sum(page.body)
+	page.etag = hex.EncodeToString(sum[:10])
+	if t, err := http.ParseTime(rec.Header().Get("Last-Modified")); err == nil {
+		page.lastModified = t
+	}
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(page.body)
+	if err == nil && gw.Close() == nil && buf.Len() < len(page.body) {
+		page.gzipped = buf.Bytes()
+	}
+	var br bytes.Buffer
+	bw := brotli.NewWriterLevel(&br, brotli.DefaultCompression)
+	_, err = bw.Write(page.body)
+	if err == nil && bw.Close() == nil && br.Len() < len(page.body) {
+		page.brotli = br.Bytes()
+	}
+	return page
+}
+
+// acceptedEncodings returns q-values of content codings in Accept-Encoding
+// of req, such as "br;q=1.0, gzip; q=0.5, *;q=0".
+func acceptedEncodings(req *http.Request) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.ToLower(strings.TrimSpace(param))
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(param[2:], 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+			q = v
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+// qvalue returns the q-value of coding, or of "*" if not listed.
+func qvalue(accepted map[string]float64, coding string) float64 {
+	if q, found := accepted[coding]; found {
+		return q
+	}
+	return accepted["*"]
+}
+
+// encoding returns the content coding of page for req and the encoded body:
+// br or gzip with higher q-value, br if the same, or identity.
+func (page *cachedPage) encoding(req *http.Request) (string, []byte) {
+	accepted := acceptedEncodings(req)
+	br, gz := qvalue(accepted, "br"), qvalue(accepted, "gzip")
+	switch {
+	case page.brotli != nil && br > 0 && (br >= gz || page.gzipped == nil):
+		return "br", page.brotli
+	case page.gzipped != nil && gz > 0:
+		return "gzip", page.gzipped
+	}
+	return "", page.body
+}
+
+// serve writes the page, or 304 Not Modified for conditional requests.
+func (page *cachedPage) serve(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	for k, v := range page.header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Add("Vary", "Accept-Encoding")
+	etag := page.etag
+	coding, body := page.encoding(req)
+	if coding != "" {
+		etag += "-" + coding
+		h.Set("Content-Encoding", coding)
+		// ranges don't make sense on the compressed body.
+		req.Header.Del("Range")
+	}
+	h.Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, req, "", page.lastModified, bytes.NewReader(body))
+}
+
+// cacheable reports whether the response for req can be cached.
+func (b *Blogplus) cacheable(req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	p := strings.TrimPrefix(req.URL.Path, b.Prefix)
+	switch {
+	case p == adminPath || strings.HasPrefix(p, adminPath+"/"):
+		return false
+	case p == goPath || p == websubPath || p == webmentionPath:
+		return false
+	case p == actorPath || strings.HasPrefix(p, actorPath+"/") || wantsActivityJSON(req):
+		// followers change without StoreHook, and post urls are
+		// negotiated by Accept.
+		return false
+	case p == micropubPath || strings.HasPrefix(p, micropubPath+"/"):
+		return false
+	case b.staticDir != "" && strings.HasPrefix(p, b.staticDir), b.MediaDir != "" && strings.HasPrefix(p, mediaPath),
+		strings.HasPrefix(p, themePath):
+		// http.FileServer handles conditional requests.
+		return false
+	}
+	return true
+}
+
+// cacheKey returns the key of the page for req in the cache.
+func cacheKey(req *http.Request) string {
+	q := req.URL.Query()
+	key := url.Values{}
+	for _, name := range cachedParams {
+		if v, found := q[name]; found {
+			key[name] = v
+		}
+	}
+	return req.Host + " " + req.URL.EscapedPath() + "?" + key.Encode()
+}
+
+func (b *Blogplus) serveCached(w http.ResponseWriter, req *http.Request) {
+	key := cacheKey(req)
+	page := b.cache.get(key)
+	if page == nil {
+		rec := httptest.NewRecorder()
+		b.route(rec, req)
+		if rec.Code != http.StatusOK {
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.Code)
+			w.Write(rec.Body.Bytes())
+			return
+		}
+		page = newCachedPage(rec)
+		b.cache.put(key, page)
+	} else if req.URL.Path == b.Prefix+mainPath {
+		// as ServeMain does.
+		b.c.MaybeFetch(req)
+	}
+	page.serve(w, req)
+}
+
+// invalidateCache is a StoreHook to flush the page cache.
+func (b *Blogplus) invalidateCache(req *http.Request, posts []Activity, reason StoreReason) {
+	b.cache.flush()
+}
+
+// setLastModified sets Last-Modified header to the latest Updated of posts.
+func setLastModified(w http.ResponseWriter, posts ...Activity) {
+	var latest time.Time
+	for _, post := range posts {
+		t, err := time.Parse(time.RFC3339, post.Updated)
+		if err == nil && t.After(latest) {
+			latest = t
+		}
+	}
+	if !latest.IsZero() {
+		w.Header().Set("Last-Modified", latest.UTC().Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,69 @@
+package blogplus
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCachedPostKeepsVary(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, actorKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, s := newTestBlogplus()
+	b.EnableActivityPub("blog", key)
+	s.StorePosts(nil, []Activity{testPost("cv1", time.Now(), "Cached post.")})
+	// served at /post/ without redirect, as posts stored before slugs.
+	s.mu.Lock()
+	post := s.m["cv1"]
+	post.Slug = ""
+	s.m["cv1"] = post
+	s.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://example.com/post/cv1", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		b.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /post/cv1: %d", w.Code)
+		}
+		vary := w.Header()["Vary"]
+		if len(vary) != 2 || vary[0] != "Accept" || vary[1] != "Accept-Encoding" {
+			t.Errorf("#%d: Vary = %q; want [Accept Accept-Encoding]", i, vary)
+		}
+	}
+}
+
+func TestCacheKeyIgnoresUnknownQuery(t *testing.T) {
+	b, s := newTestBlogplus()
+	s.StorePosts(nil, []Activity{testPost("ck1", time.Now(), "Cached post.")})
+	for _, q := range []string{"", "?x=1", "?x=2&y=3"} {
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/"+q, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /%s: %d", q, w.Code)
+		}
+	}
+	if n := len(b.cache.m); n != 1 {
+		t.Errorf("%d pages cached; want 1", n)
+	}
+	for _, tc := range []struct{ a, b string }{
+		{"/?x=1", "/"},
+		{"/.well-known/webfinger?resource=acct:a@example.com&x=1", "/.well-known/webfinger?resource=acct:a@example.com"},
+	} {
+		ka := cacheKey(httptest.NewRequest("GET", "http://example.com"+tc.a, nil))
+		kb := cacheKey(httptest.NewRequest("GET", "http://example.com"+tc.b, nil))
+		if ka != kb {
+			t.Errorf("cacheKey(%s) = %q; want %q", tc.a, ka, kb)
+		}
+	}
+	ka := cacheKey(httptest.NewRequest("GET", "http://example.com/.well-known/webfinger?resource=acct:a@example.com", nil))
+	kb := cacheKey(httptest.NewRequest("GET", "http://example.com/.well-known/webfinger?resource=acct:b@example.com", nil))
+	if ka == kb {
+		t.Errorf("cacheKey ignores resource: %q", ka)
+	}
+}
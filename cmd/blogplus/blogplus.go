@@ -3,10 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"github.com/ukai/blogplus"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -25,13 +27,34 @@ var (
 	scheme     string
 	host       string
 
+	filterFile  string
+	policyFile  string
+	includeTags string
+	excludeTags string
+
+	adminPasswordHash string
+	noCache           bool
+
+	hub        string
+	builtinHub bool
+	webmention bool
+	actorName  string
+	actorKey   string
+
+	micropubTokens string
+	mediaDir       string
+
+	robotsTxt string
+
+	themeDir     string
 	staticDir    string
 	templateDir  string
 	dumpTemplate bool
+	dev          bool
 )
 
 func init() {
-	flag.StringVar(&userId, "user_id", "", "user id")
+	flag.StringVar(&userId, "user_id", "", "comma separated user ids")
 	flag.StringVar(&key, "key", "", "api key")
 	flag.StringVar(&addr, "addr", ":80", "listen address")
 	flag.DurationVar(&timeout, "timeout", 1*time.Hour, "timeout")
@@ -43,59 +66,201 @@ func init() {
 	flag.StringVar(&authorUri, "author_uri", "http://example.com", "author's uri")
 	flag.StringVar(&scheme, "scheme", "http", "url scheme")
 	flag.StringVar(&host, "host", "", "url host")
+	flag.StringVar(&filterFile, "filter", "", "filter rules file in JSON")
+	flag.StringVar(&policyFile, "sanitize_policy", "", "HTML sanitize policy file in JSON")
+	flag.StringVar(&includeTags, "include_tags", "", "comma separated hashtags; store only posts having any of them")
+	flag.StringVar(&excludeTags, "exclude_tags", "", "comma separated hashtags; don't store posts having any of them")
+	flag.StringVar(&adminPasswordHash, "admin_password_hash", "", "bcrypt hash of admin password; see hash-password command")
+	flag.BoolVar(&noCache, "no_cache", false, "disable page cache")
+	flag.StringVar(&hub, "websub_hub", "", "url of WebSub hub to notify of new posts")
+	flag.BoolVar(&builtinHub, "builtin_hub", false, "serve a WebSub hub at /websub, unless websub_hub is set")
+	flag.BoolVar(&webmention, "webmention", false, "send Webmentions for links in posts and accept them at /webmention")
+	flag.StringVar(&actorName, "actor_name", "", "publish the blog as ActivityPub actor @actor_name@host")
+	flag.StringVar(&actorKey, "actor_key", "actor.pem", "RSA private key of the ActivityPub actor; created if missing")
+	flag.StringVar(&micropubTokens, "micropub_tokens", "", "comma separated bearer tokens accepted at /micropub; disabled if empty")
+	flag.StringVar(&mediaDir, "media_dir", "", "directory of media uploaded by Micropub, served at /media/")
+	flag.StringVar(&robotsTxt, "robots_txt", "", "file served as /robots.txt, followed by the sitemap")
+	flag.StringVar(&themeDir, "theme", "", "theme directory of templates and assets, over the default theme")
 	flag.StringVar(&staticDir, "static_dir", "", "static_dir")
 	flag.StringVar(&templateDir, "template_dir", "", "template_dir")
 	flag.BoolVar(&dumpTemplate, "dump_template", false, "dump template")
+	flag.BoolVar(&dev, "dev", false, "development mode: reloads theme, template_dir and static_dir when changed, and shows template errors in pages")
+}
+
+func openStorage() blogplus.Storage {
+	if driver == "memory" {
+		return blogplus.NewMemStorage()
+	}
+	if initDb {
+		blogplus.InitDB(driver, datasource)
+	}
+	s, err := blogplus.NewDBStorage(driver, datasource)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func filterRules() *blogplus.FilterRules {
+	rules := blogplus.DefaultFilterRules
+	if filterFile != "" {
+		r, err := blogplus.LoadFilterRules(filterFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rules = *r
+	}
+	if includeTags != "" {
+		rules.IncludeTags = strings.Split(includeTags, ",")
+	}
+	if excludeTags != "" {
+		rules.ExcludeTags = strings.Split(excludeTags, ",")
+	}
+	return &rules
 }
 
 func main() {
 	flag.Parse()
-	c := NewController(timeout)
-	var s blogplus.Storage
-	var err error
-	if driver == "memory" {
-		s = blogplus.NewMemStorage()
-	} else {
-		if initDb {
-			blogplus.InitDB(driver, datasource)
+	var command string
+	var args []string
+	if flag.NArg() > 0 {
+		command, args = flag.Arg(0), flag.Args()[1:]
+		if command == "filter-test" {
+			// global flags may also be given after the command.
+			flag.CommandLine.Parse(args)
 		}
-		s, err = blogplus.NewDBStorage(driver, datasource)
+	}
+	if command == "hash-password" {
+		hashPassword()
+		return
+	}
+	if policyFile != "" {
+		// before opening the storage, which may sanitize posts to upgrade.
+		policy, err := blogplus.LoadSanitizePolicy(policyFile)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
+		blogplus.ContentPolicy = policy
 	}
-	s.SetFilter(blogplus.IsMeaningfulPost)
-	fetcher := blogplus.NewFetcher(userId, key)
+	c := NewController(timeout)
+	s := openStorage()
+	rules := filterRules()
+	s.SetFilter(rules.Match)
 
-	b := blogplus.NewBlogplus(s, c)
+	var ctl blogplus.Controller = c
+	if command == "build" {
+		// no fetch while building.
+		ctl = nopController{}
+	}
+	b := blogplus.NewBlogplus(s, ctl)
 	b.Title = title
 	b.AuthorName = authorName
 	b.AuthorUri = authorUri
 	b.Scheme = scheme
+	b.AdminPasswordHash = adminPasswordHash
+	b.Filter = rules
+	b.NoCache = noCache
+	b.Hub = hub
+	b.Webmention = webmention
+	if micropubTokens != "" {
+		b.MicropubTokens = strings.Split(micropubTokens, ",")
+	}
+	b.MediaDir = mediaDir
+	if robotsTxt != "" {
+		data, err := ioutil.ReadFile(robotsTxt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b.RobotsTxt = string(data)
+	}
+	if builtinHub {
+		b.EnableHub()
+	}
+	if actorName != "" {
+		key, err := blogplus.LoadActorKey(actorKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b.EnableActivityPub(actorName, key)
+	}
 	if host == "" {
 		b.Host = "localhost" + addr
 	} else {
 		b.Host = host
 	}
-	b.SetStaticDir(staticDir)
+	switch command {
+	case "":
+	case "filter-test":
+		filterTest(s, rules)
+		return
+	case "moderate":
+		moderate(s, args)
+		return
+	case "redirects":
+		redirects(b, args)
+		return
+	case "build", "reprocess":
+		// after templates are loaded.
+	default:
+		log.Fatal("unknown command: ", command)
+	}
+
 	if dumpTemplate {
 		if templateDir == "" {
-			panic("need template_dir")
+			log.Fatal("need template_dir")
 		}
 		fmt.Printf("Extracting template in %s...", templateDir)
-		b.ExtractTemplates(templateDir)
+		err := b.ExtractTemplates(templateDir)
+		if err != nil {
+			log.Fatal(err)
+		}
 		fmt.Println("done")
 		return
 	}
+	b.Dev = dev
+	if themeDir != "" {
+		checkTemplateError(b.SetTheme(blogplus.DirTheme(themeDir)))
+	}
+	checkTemplateError(b.SetStaticDir(staticDir))
 	if templateDir != "" {
-		b.LoadTemplates(templateDir)
+		checkTemplateError(b.LoadTemplates(templateDir))
+	}
+	switch command {
+	case "build":
+		build(b, args)
+		return
+	case "reprocess":
+		// attachment templates are used to prepare posts.
+		s.SetFilter(nil)
+		fmt.Printf("%d posts reprocessed\n", blogplus.Reprocess(s, nil))
+		return
 	}
 
-	go c.Run(fetcher, s)
+	var fetchers []*blogplus.Fetcher
+	for _, id := range strings.Split(userId, ",") {
+		fetchers = append(fetchers, blogplus.NewFetcher(strings.TrimSpace(id), key))
+	}
+	go c.Run(fetchers, s)
+	if dev {
+		go b.WatchTheme(time.Second)
+	}
 	http.Handle("/", b)
 	log.Println("start serving ", addr)
-	err = http.ListenAndServe(addr, nil)
+	err := http.ListenAndServe(addr, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// checkTemplateError exits on err, unless in development mode, where
+// the error is shown in pages until the files are fixed.
+func checkTemplateError(err error) {
+	if err == nil {
+		return
+	}
+	if dev {
+		log.Println("template error:", err)
+		return
+	}
+	log.Fatal(err)
+}
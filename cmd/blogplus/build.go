@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ukai/blogplus"
+	"log"
+	"net/http"
+)
+
+type nopController struct{}
+
+func (nopController) ForceFetch(req *http.Request)                        {}
+func (nopController) MaybeFetch(req *http.Request)                        {}
+func (nopController) MaybeFetchPost(req *http.Request, activityId string) {}
+func (nopController) Status(req *http.Request) blogplus.FetchStatus {
+	return blogplus.FetchStatus{}
+}
+
+// build renders the blog as static files.
+//
+//	blogplus -host example.com build -out dir
+func build(b *blogplus.Blogplus, args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	out := fs.String("out", "", "output directory")
+	fs.Parse(args)
+	if *out == "" {
+		log.Fatal("build: need -out")
+	}
+	result, err := b.Build(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d files written, %d unchanged, %d removed\n", result.Written, result.Unchanged, result.Removed)
+}
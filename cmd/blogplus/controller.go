@@ -16,6 +16,7 @@ type Controller struct {
 	mu          sync.Mutex
 	fetchCount  int
 	fetchCounts map[string]int
+	status      blogplus.FetchStatus
 
 	event   chan *string
 	done    chan bool
@@ -31,18 +32,18 @@ func NewController(timeout time.Duration) *Controller {
 	return fs
 }
 
-func fetchAllPosts(fetcher *blogplus.Fetcher, storage blogplus.Storage) {
+func fetchAllPosts(fetcher *blogplus.Fetcher, storage blogplus.Storage) (int, error) {
 	client := &http.Client{}
 	var req *http.Request
 	latest_ids := make(map[string]bool)
-	for _, post := range storage.GetLatestPosts(req) {
+	for _, post := range storage.GetAuthorPosts(req, fetcher.UserId()) {
 		latest_ids[post.Id] = true
 	}
-	log.Println("fetch the latest...")
+	log.Println("fetch the latest of", fetcher.UserId(), "...")
 	activityFeed, err := fetcher.GetActivities(client, "")
 	if err != nil {
 		log.Println("fetcher error:", err)
-		return
+		return 0, err
 	}
 	var allItems []blogplus.Activity
 Loop:
@@ -64,10 +65,50 @@ Loop:
 	}
 	storage.StorePosts(req, allItems)
 	log.Println("fetch the latest done")
+	return len(allItems), err
 }
 
-func (c *Controller) Run(fetcher *blogplus.Fetcher, storage blogplus.Storage) {
-	fetchAllPosts(fetcher, storage)
+// fetchPost fetches the post with the fetcher of its author, or with
+// each fetcher until one finds it if the author is unknown.
+func fetchPost(fetchers []*blogplus.Fetcher, storage blogplus.Storage, activityId string) []blogplus.Activity {
+	client := &http.Client{}
+	var req *http.Request
+	if post, found := storage.GetPost(req, activityId); found {
+		for _, fetcher := range fetchers {
+			if fetcher.UserId() == post.Actor.Id {
+				return fetcher.FetchPost(client, activityId)
+			}
+		}
+	}
+	for _, fetcher := range fetchers {
+		posts := fetcher.FetchPost(client, activityId)
+		if len(posts) > 0 && posts[0].Id == activityId {
+			return posts
+		}
+	}
+	return nil
+}
+
+func (c *Controller) setStatus(fetched int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = blogplus.FetchStatus{LastFetch: time.Now(), Fetched: fetched}
+	if err != nil {
+		c.status.Err = err.Error()
+	}
+}
+
+func (c *Controller) Run(fetchers []*blogplus.Fetcher, storage blogplus.Storage) {
+	total := 0
+	var lastErr error
+	for _, fetcher := range fetchers {
+		n, err := fetchAllPosts(fetcher, storage)
+		total += n
+		if err != nil {
+			lastErr = err
+		}
+	}
+	c.setStatus(total, lastErr)
 	for {
 		var activityId *string
 		select {
@@ -80,12 +121,15 @@ func (c *Controller) Run(fetcher *blogplus.Fetcher, storage blogplus.Storage) {
 		}
 		var posts []blogplus.Activity
 		if activityId != nil && *activityId != "" {
-			posts = fetcher.FetchPost(&http.Client{}, *activityId)
+			posts = fetchPost(fetchers, storage, *activityId)
 		} else {
-			posts = fetcher.Fetch(&http.Client{})
+			for _, fetcher := range fetchers {
+				posts = append(posts, fetcher.Fetch(&http.Client{})...)
+			}
 		}
 		var req *http.Request
 		storage.StorePosts(req, posts)
+		c.setStatus(len(posts), nil)
 	}
 }
 
@@ -137,3 +181,9 @@ func (c *Controller) Finish(req *http.Request) {
 	c.event <- nil
 	<-c.done
 }
+
+func (c *Controller) Status(req *http.Request) blogplus.FetchStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ukai/blogplus"
+	"net/http"
+)
+
+// filterTest prints stored posts that rules would drop, including
+// hidden posts.
+func filterTest(s blogplus.Storage, rules *blogplus.FilterRules) {
+	var req *http.Request
+	total, dropped := 0, 0
+	for _, post := range blogplus.GetStoredPosts(s, req) {
+		total++
+		ok, reason := rules.Explain(post)
+		if ok {
+			continue
+		}
+		dropped++
+		hidden := ""
+		if post.Override.Hidden {
+			hidden = " (hidden)"
+		}
+		fmt.Printf("drop %s %s%s %s: %q\n", post.Id, post.Published, hidden, reason, post.Title)
+	}
+	fmt.Printf("%d of %d posts would be dropped\n", dropped, total)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ukai/blogplus"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// moderate manages per-post overrides.
+//
+//	blogplus moderate -list
+//	blogplus moderate [-hide|-unhide] [-pin|-unpin] [-subject s] [-slug s] activityId
+func moderate(s blogplus.Storage, args []string) {
+	fs := flag.NewFlagSet("moderate", flag.ExitOnError)
+	list := fs.Bool("list", false, "list overrides")
+	hide := fs.Bool("hide", false, "hide the post")
+	unhide := fs.Bool("unhide", false, "unhide the post")
+	pin := fs.Bool("pin", false, "pin the post")
+	unpin := fs.Bool("unpin", false, "unpin the post")
+	subject := fs.String("subject", "", "custom subject; \"-\" to clear")
+	slug := fs.String("slug", "", "custom slug; \"-\" to clear")
+	fs.Parse(args)
+
+	var req *http.Request
+	overrides := s.GetOverrides(req)
+	if *list {
+		var ids []string
+		for id := range overrides {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			fmt.Printf("%s %+v\n", id, overrides[id])
+		}
+		return
+	}
+	if fs.NArg() != 1 {
+		log.Fatal("moderate: need an activity id")
+	}
+	activityId := fs.Arg(0)
+	if _, found := s.GetPost(req, activityId); !found {
+		log.Fatal("moderate: no such post: ", activityId)
+	}
+	o := overrides[activityId]
+	if *hide {
+		o.Hidden = true
+	}
+	if *unhide {
+		o.Hidden = false
+	}
+	if *pin {
+		o.Pinned = true
+	}
+	if *unpin {
+		o.Pinned = false
+	}
+	switch *subject {
+	case "":
+	case "-":
+		o.Subject = ""
+	default:
+		o.Subject = *subject
+	}
+	switch *slug {
+	case "":
+	case "-":
+		o.Slug = ""
+	default:
+		o.Slug = blogplus.MakeSlug(*slug)
+		if o.Slug == "" {
+			log.Fatal("moderate: bad slug: ", *slug)
+		}
+	}
+	err := s.SetOverride(req, activityId, o)
+	if err != nil {
+		log.Fatal("moderate: ", err)
+	}
+	fmt.Printf("%s %+v\n", activityId, o)
+}
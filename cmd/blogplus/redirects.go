@@ -0,0 +1,21 @@
+package main
+
+import (
+	"flag"
+	"github.com/ukai/blogplus"
+	"log"
+	"os"
+)
+
+// redirects prints the redirect map from original post urls to permalinks.
+//
+//	blogplus -host example.com redirects [-format nginx|apache|csv]
+func redirects(b *blogplus.Blogplus, args []string) {
+	fs := flag.NewFlagSet("redirects", flag.ExitOnError)
+	format := fs.String("format", blogplus.RedirectMapNginx, "nginx, apache or csv")
+	fs.Parse(args)
+	err := b.WriteRedirectMap(os.Stdout, *format)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
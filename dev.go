@@ -0,0 +1,171 @@
+package blogplus
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Development mode: the theme is parsed again when its files change, and
+// template errors are shown over the page with the file and the line.
+
+var (
+	// "template: entry:12: ...", "template: entry:12:5: executing ..."
+	// or "html/template:entry:12:5: ...".
+	templateErrorRe = regexp.MustCompile(`^(?:html/)?template: ?([^:\s]+):(\d+)(?::\d+)?: (.*)$`)
+)
+
+// number of lines shown around the line of a template error.
+const templateErrorContext = 2
+
+// templateError is a template error shown in development mode.
+type templateError struct {
+	Kind    string // "parse" or "execution"
+	File    string
+	Line    int
+	Message string
+	Source  []templateSourceLine
+}
+
+type templateSourceLine struct {
+	N     int
+	Text  string
+	Error bool
+}
+
+// newTemplateError returns the details of err of templates of t.
+func newTemplateError(kind string, t *Theme, err error) *templateError {
+	te := &templateError{Kind: kind, Message: err.Error()}
+	m := templateErrorRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return te
+	}
+	name := m[1] + ".tmpl"
+	te.File = t.filename(name)
+	if te.File == "" {
+		// a template defined in another file.
+		te.File = m[1]
+	}
+	te.Line, _ = strconv.Atoi(m[2])
+	te.Message = m[3]
+	data, err := t.ReadFile(name)
+	if err != nil {
+		return te
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for n := te.Line - templateErrorContext; n <= te.Line+templateErrorContext; n++ {
+		if n < 1 || n > len(lines) {
+			continue
+		}
+		te.Source = append(te.Source, templateSourceLine{N: n, Text: lines[n-1], Error: n == te.Line})
+	}
+	return te
+}
+
+// executeBase renders tc with the base template of the theme.
+// In development mode, template errors are shown over the page:
+// a parse error over the page rendered with the last good templates,
+// and an execution error over what was rendered until the error.
+func (b *Blogplus) executeBase(w http.ResponseWriter, tc *TemplateContext) {
+	tt := b.templates()
+	if !b.Dev {
+		err := tt.base.Execute(w, tc)
+		if err != nil {
+			log.Println("template error:", err)
+		}
+		return
+	}
+	b.themeMu.RLock()
+	te := b.themeErr
+	b.themeMu.RUnlock()
+	var buf bytes.Buffer
+	err := tt.base.Execute(&buf, tc)
+	if err != nil {
+		log.Println("template error:", err)
+		te = newTemplateError("execution", tt.theme, err)
+		w.Header().Del("Last-Modified")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	page := buf.Bytes()
+	if te != nil {
+		var overlay bytes.Buffer
+		err = templateErrorTempl.Execute(&overlay, te)
+		if err != nil {
+			log.Println("template error overlay error:", err)
+		}
+		// before </body>, or at the end of a partial page.
+		i := bytes.LastIndex(page, []byte("</body>"))
+		if i < 0 {
+			i = len(page)
+		}
+		page = append(page[:i:i], append(overlay.Bytes(), page[i:]...)...)
+	}
+	_, err = w.Write(page)
+	if err != nil {
+		log.Println("write error:", err)
+	}
+}
+
+// themeStamp returns a string that changes when files of t change.
+func themeStamp(t *Theme) string {
+	var stamp strings.Builder
+	for ; t != nil; t = t.Parent {
+		err := fs.WalkDir(t.FS, ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&stamp, "%s %d %d\n", p, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(&stamp, "%v\n", err)
+		}
+	}
+	return stamp.String()
+}
+
+// WatchTheme checks files of the theme, including the static dir and
+// the template dir, every interval, and parses the theme again when they
+// change. The last good templates are used while the theme fails to parse;
+// see SetTheme. Attachment templates are not reloaded, since attachments
+// are formed when posts are stored. It doesn't return.
+func (b *Blogplus) WatchTheme(interval time.Duration) {
+	last := themeStamp(b.Theme())
+	for range time.Tick(interval) {
+		t := b.Theme()
+		stamp := themeStamp(t)
+		if stamp == last {
+			continue
+		}
+		last = stamp
+		err := b.SetTheme(t)
+		if err != nil {
+			log.Println("theme reload error:", err)
+			continue
+		}
+		log.Println("theme reloaded")
+	}
+}
+
+var templateErrorTempl = template.Must(template.New("template_error").Parse(templateErrorHTML))
+
+const templateErrorHTML = `<div id="template-error" style="position:fixed;left:0;right:0;bottom:0;max-height:50%;overflow:auto;z-index:10000;margin:0;padding:1em;background:#fff0f0;color:#600;border-top:3px solid #c00;font:13px/1.5 monospace;text-align:left">
+ <strong>template {{.Kind}} error</strong>{{if .File}} in {{.File}}{{if .Line}}:{{.Line}}{{end}}{{end}}
+ {{if eq .Kind "parse"}}<em>(showing the last good templates)</em>{{end}}
+ <div>{{.Message}}</div>
+ {{if .Source}}<pre style="margin:0.5em 0 0;background:#fff;color:#333">{{range .Source}}<span{{if .Error}} style="background:#fcc"{{end}}>{{printf "%4d" .N}}  {{.Text}}</span>
+{{end}}</pre>{{end}}
+</div>
+`
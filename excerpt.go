@@ -0,0 +1,69 @@
+package blogplus
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	contentExcerptLength = 600 // in runes of text
+
+	// moreMarker ends the excerpt of a post, if any.
+	moreMarker = "<!--more-->"
+)
+
+// extractContentExcerpt sets the excerpt of the content shown in list pages.
+// It is cut at moreMarker or at contentExcerptLength runes of text, and
+// elements open there are closed. The sanitized content is used, so that
+// its markup is well-formed. If the whole content fits, the excerpt is empty.
+func extractContentExcerpt(post *Activity) {
+	post.Object.ContentExcerpt = ""
+	post.Object.Truncated = false
+	content := post.Object.SanitizedContent
+	var b strings.Builder
+	var open []string
+	n, pos := 0, 0
+	z := html.NewTokenizer(strings.NewReader(content))
+loop:
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return
+		}
+		raw := z.Raw()
+		pos += len(raw)
+		switch tt {
+		case html.CommentToken:
+			if string(raw) == moreMarker {
+				if strings.TrimSpace(content[pos:]) == "" {
+					return
+				}
+				break loop
+			}
+		case html.TextToken:
+			text := []rune(html.UnescapeString(string(raw)))
+			if n+len(text) > contentExcerptLength {
+				cut := cutPoint(text, contentExcerptLength-n)
+				b.WriteString(html.EscapeString(strings.TrimRightFunc(string(text[:cut]), unicode.IsSpace)) + "…")
+				break loop
+			}
+			n += len(text)
+		case html.StartTagToken:
+			if name, _ := z.TagName(); !voidElements[string(name)] {
+				open = append(open, string(name))
+			}
+		case html.EndTagToken:
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+		}
+		b.Write(raw)
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+	post.Object.ContentExcerpt = b.String()
+	post.Object.Truncated = true
+}
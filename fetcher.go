@@ -25,6 +25,10 @@ func NewFetcher(userId, key string) *Fetcher {
 	return fetcher
 }
 
+func (fetcher *Fetcher) UserId() string {
+	return fetcher.userId
+}
+
 func (fetcher *Fetcher) GetActivities(client *http.Client, pageToken string) (*ActivityFeed, error) {
 	url := BaseURL + "people/" + fetcher.userId + "/activities/public?num=100&key=" + fetcher.key
 	if pageToken != "" {
@@ -0,0 +1,125 @@
+package blogplus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"unicode/utf8"
+)
+
+// FilterRules describes which posts are stored.
+// Rules are evaluated in this order: DenyIds, AllowIds, Verbs,
+// AttachmentTypes, ExcludeTags, IncludeTags, Deny and MinLength.
+type FilterRules struct {
+	// minimum length of tag-stripped content, in runes. posts created
+	// by Micropub, such as short notes, are not checked.
+	MinLength int `json:"min_length"`
+	// if not empty, only posts with these verbs are stored.
+	Verbs []string `json:"verbs"`
+	// if not empty, only posts having any of these tags are stored.
+	IncludeTags []string `json:"include_tags"`
+	// posts having any of these tags are dropped.
+	ExcludeTags []string `json:"exclude_tags"`
+	// if not empty, posts having an attachment of other types are dropped.
+	AttachmentTypes []string `json:"attachment_types"`
+	// posts whose tag-stripped content matches any of these regexps are dropped.
+	Deny []string `json:"deny"`
+	// activity ids always stored, regardless of other rules.
+	AllowIds []string `json:"allow_ids"`
+	// activity ids never stored.
+	DenyIds []string `json:"deny_ids"`
+
+	deny []*regexp.Regexp
+}
+
+// DefaultFilterRules stores posts and checkins with at least 200 runes
+// of tag-stripped content. Note that the fixed filter before FilterRules
+// stored any verb but share, with more than 200 bytes of content.
+var DefaultFilterRules = FilterRules{
+	MinLength: 200,
+	Verbs:     []string{"post", "checkin"},
+}
+
+// LoadFilterRules reads FilterRules in JSON from filename.
+func LoadFilterRules(filename string) (*FilterRules, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rules FilterRules
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	err = rules.Compile()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return &rules, nil
+}
+
+// Compile compiles Deny regexps. It must be called again after Deny is modified.
+func (r *FilterRules) Compile() error {
+	r.deny = nil
+	for _, expr := range r.Deny {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		r.deny = append(r.deny, re)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Explain reports whether post passes the rules, and why if not.
+func (r *FilterRules) Explain(post Activity) (bool, string) {
+	if contains(r.DenyIds, post.Id) {
+		return false, "denied id"
+	}
+	if contains(r.AllowIds, post.Id) {
+		return true, "allowed id"
+	}
+	if len(r.Verbs) > 0 && !contains(r.Verbs, post.Verb) {
+		return false, "verb " + post.Verb
+	}
+	if len(r.AttachmentTypes) > 0 {
+		for _, attachment := range post.Object.Attachments {
+			if !contains(r.AttachmentTypes, attachment.ObjectType) {
+				return false, "attachment type " + attachment.ObjectType
+			}
+		}
+	}
+	tags := extractTags(post.Object.Content)
+	if hasAnyTag(tags, r.ExcludeTags) {
+		return false, "excluded tag"
+	}
+	if len(r.IncludeTags) > 0 && !hasAnyTag(tags, r.IncludeTags) {
+		return false, "no included tag"
+	}
+	text := htmlTagRe.ReplaceAllString(post.Object.Content, "")
+	for _, re := range r.deny {
+		if re.MatchString(text) {
+			return false, "denied by " + re.String()
+		}
+	}
+	if n := utf8.RuneCountInString(text); n < r.MinLength && post.Source == nil {
+		return false, fmt.Sprintf("too short (%d < %d)", n, r.MinLength)
+	}
+	return true, ""
+}
+
+// Match reports whether post passes the rules. It can be used with Storage.SetFilter.
+func (r *FilterRules) Match(post Activity) bool {
+	ok, _ := r.Explain(post)
+	return ok
+}
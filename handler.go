@@ -1,34 +1,40 @@
 package blogplus
 
 import (
+	"crypto/rsa"
 	"encoding/xml"
-	"fmt"
-	"html/template"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
-	text_template "text/template"
+	"sync"
 )
 
 var (
-	activityIdRe = regexp.MustCompile("[a-zA-Z0-9]+")
-	dateSpecRe   = regexp.MustCompile("\\d+-\\d+")
+	activityIdRe = regexp.MustCompile("^[a-zA-Z0-9]+$")
+	dateSpecRe   = regexp.MustCompile(`^\d{4}(-\d{2})?$`)
+	actorIdRe    = regexp.MustCompile("^[a-zA-Z0-9]+$")
+	tagRe        = regexp.MustCompile(`^[\p{L}\p{N}_]+$`)
 )
 
 const (
 	mainPath       = "/"
 	postPath       = "/post/"
 	archivePath    = "/archive/"
+	authorPath     = "/author/"
+	tagPath        = "/tag/"
 	atomFeedPath   = "/feed"
-	forceFetchPath = "/forcefetch"
+	rssFeedPath    = "/feed.rss"
+	jsonFeedPath   = "/feed.json"
+	feedPagePath   = "/feed-page/" // not /feed/page/, as /feed is a file in Build
+	fullFeedPath   = "/feed-full"
 	archivesJsPath = "/js/archives.js"
+	goPath         = "/go"
 )
 
 type Blogplus struct {
@@ -43,96 +49,158 @@ type Blogplus struct {
 	Host   string
 	Prefix string
 
+	// bcrypt hash of the admin password. admin pages are disabled if empty.
+	AdminPasswordHash string
+	// filter rules shown in admin pages. DefaultFilterRules if nil.
+	Filter *FilterRules
+	// disables the page cache.
+	NoCache bool
+	// url of the WebSub hub, advertised in feeds and notified of
+	// new posts. overrides the built-in hub enabled by EnableHub.
+	Hub string
+	// sends Webmentions for links in new posts, and accepts
+	// Webmentions at /webmention.
+	Webmention bool
+	// preferred username of the ActivityPub actor; see EnableActivityPub.
+	ActorName string
+	// bearer tokens accepted by the Micropub endpoint at /micropub.
+	// the endpoint is disabled if empty.
+	MicropubTokens []string
+	// directory of media uploaded by Micropub, served at /media/.
+	// uploads are disabled if empty.
+	MediaDir string
+	// content of /robots.txt, followed by the sitemap.
+	// admin pages are disallowed if empty.
+	RobotsTxt string
+	// development mode: template errors are shown in pages, and the
+	// page cache is disabled. see WatchTheme.
+	Dev bool
+
 	staticDir string
 	fs        http.Handler
+	themeMu   sync.RWMutex
+	theme     *themeTemplates
+	themeSrc  *Theme
+	themeErr  *templateError
+	sessions  adminSessions
+	cache     pageCache
+	hub       *websubHub
+	actorKey  *rsa.PrivateKey
+
+	mentionVerifying chan struct{} // semaphore of received Webmentions
 }
 
 type Controller interface {
 	ForceFetch(req *http.Request)
 	MaybeFetch(req *http.Request)
 	MaybeFetchPost(req *http.Request, activityId string)
+	Status(req *http.Request) FetchStatus
 }
 
 func NewBlogplus(s Storage, c Controller) *Blogplus {
-	return &Blogplus{storage: s, c: c, Prefix: ""}
+	b := &Blogplus{storage: s, c: c, Prefix: "",
+		mentionVerifying: make(chan struct{}, maxMentionVerifications)}
+	s.AddStoreHook(b.invalidateCache)
+	s.AddStoreHook(b.notifyHub)
+	s.AddStoreHook(b.sendWebmentions)
+	s.AddStoreHook(b.deliverPosts)
+	return b
 }
 
-func (b *Blogplus) SetStaticDir(dir string) {
-	if dir != "" {
-		b.staticDir = "/" + dir
-		b.fs = http.FileServer(http.Dir("."))
-		headerTempl = ""
-		if f, err := os.Open(filepath.Join(dir, "favicon.png")); err == nil {
-			headerTempl += fmt.Sprintf(`<link rel="shortcut icon" href="{{.Blogplus.Prefix}}/%s/favicon.png"/>`, dir)
-			f.Close()
-		} else {
-			log.Println("missing favicon.png")
-		}
-		if f, err := os.Open(filepath.Join(dir, "style.css")); err != nil {
-			err = ioutil.WriteFile(filepath.Join(dir, "style.css"),
-				[]byte(styleCss), os.FileMode(0644))
-			if err != nil {
-				log.Println("create style.css error:", err)
-			}
-		} else {
-			f.Close()
-		}
-		headerTempl += fmt.Sprintf(`<link rel="stylesheet" href="{{.Blogplus.Prefix}}/%s/style.css"/>`, dir)
-		_, err := HeaderTempl.Parse(headerTempl)
-		if err != nil {
-			panic(err)
-		}
+// SetStaticDir serves files in dir at /dir/ from disk. Small files of
+// the asset types in dir, such as style.css and favicon.png, are also
+// used as assets of the theme; templates in dir are not used.
+func (b *Blogplus) SetStaticDir(dir string) error {
+	if dir == "" {
+		return nil
 	}
+	b.staticDir = "/" + dir
+	b.fs = http.FileServer(http.Dir("."))
+	return b.SetTheme(&Theme{FS: os.DirFS(dir), Dir: dir, Parent: b.Theme(), AssetsOnly: true})
 }
 
-func (b *Blogplus) ExtractTemplates(dir string) {
-	_ = os.MkdirAll(dir, os.FileMode(0755))
-
-	createTempl(dir, "base.tmpl", baseTempl)
-	createTempl(dir, "header.tmpl", headerTempl)
-	createTempl(dir, "entry.tmpl", entryTempl)
-	createTempl(dir, "sidebar.tmpl", sidebarTempl)
-	createTempl(dir, "archive.tmpl", archiveTempl)
-	createTempl(dir, "archives.js.tmpl", archivesJsTempl)
-	createTempl(dir, "image_attachment.tmpl", imageAttachmentTempl)
-	createTempl(dir, "text_attachment.tmpl", textAttachmentTempl)
+// ExtractTemplates writes the files of the default theme into dir.
+func (b *Blogplus) ExtractTemplates(dir string) error {
+	err := os.MkdirAll(dir, os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	return ExtractTheme(dir)
 }
 
-func (b *Blogplus) LoadTemplates(dir string) {
-	BaseTempl = template.New("base")
-	loadTempl(dir, "base.tmpl", BaseTempl)
-	HeaderTempl = BaseTempl.New("header")
-	loadTempl(dir, "header.tmpl", HeaderTempl)
-	EntryTempl = BaseTempl.New("entry")
-	loadTempl(dir, "entry.tmpl", EntryTempl)
-	SidebarTempl = BaseTempl.New("sidebar")
-	loadTempl(dir, "sidebar.tmpl", SidebarTempl)
-	ArchiveTempl = SidebarTempl.New("archive")
-	loadTempl(dir, "archive.tmpl", ArchiveTempl)
-	ArchivesJsTempl = text_template.New("archives.js")
-	loadTextTempl(dir, "archives.js.tmpl", ArchivesJsTempl)
-	ImageAttachmentTempl = template.New("image_attachment")
-	loadTempl(dir, "image_attachment.tmpl", ImageAttachmentTempl)
-	TextAttachmentTempl = template.New("text_attachment")
-	loadTempl(dir, "text_attachment.tmpl", TextAttachmentTempl)
+// LoadTemplates uses files in dir as the theme of b, over the current one.
+// The attachment templates in dir are used for posts stored hereafter
+// in the storage of b.
+func (b *Blogplus) LoadTemplates(dir string) error {
+	t := &Theme{FS: os.DirFS(dir), Dir: dir, Parent: b.Theme()}
+	templ, err := ParseAttachmentTemplates(t)
+	if err != nil {
+		return err
+	}
+	err = b.SetTheme(t)
+	if err != nil {
+		return err
+	}
+	b.storage.SetAttachmentTemplates(templ)
+	return nil
 }
 
 func (b *Blogplus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !b.NoCache && !b.Dev && b.cacheable(req) {
+		b.serveCached(w, req)
+		return
+	}
+	b.route(w, req)
+}
+
+func (b *Blogplus) route(w http.ResponseWriter, req *http.Request) {
 	switch req.URL.Path {
 	case b.Prefix + mainPath:
 		b.ServeMain(w, req)
-	case b.Prefix + atomFeedPath:
+	case b.Prefix + atomFeedPath, b.Prefix + rssFeedPath, b.Prefix + jsonFeedPath, b.Prefix + fullFeedPath:
 		b.ServeFeed(w, req)
-	case b.Prefix + forceFetchPath:
-		b.ServeForceFetch(w, req)
+	case b.Prefix + adminPath:
+		b.ServeAdmin(w, req)
 	case b.Prefix + archivesJsPath:
 		b.ServeArchivesJs(w, req)
+	case b.Prefix + goPath:
+		b.ServeGo(w, req)
+	case b.Prefix + websubPath:
+		b.ServeWebSub(w, req)
+	case b.Prefix + webmentionPath:
+		b.ServeWebmention(w, req)
+	case webfingerPath, b.Prefix + webfingerPath:
+		b.ServeWebfinger(w, req)
+	case b.Prefix + actorPath, b.Prefix + inboxPath, b.Prefix + outboxPath, b.Prefix + followersPath:
+		b.ServeActor(w, req)
+	case b.Prefix + micropubPath, b.Prefix + micropubPath + mediaPath:
+		b.ServeMicropub(w, req)
+	case b.Prefix + sitemapPath:
+		b.ServeSitemap(w, req)
+	case robotsPath, b.Prefix + robotsPath:
+		b.ServeRobots(w, req)
 	default:
-		if strings.HasPrefix(req.URL.Path, b.Prefix+postPath) {
+		if strings.HasPrefix(req.URL.Path, b.Prefix+feedPagePath) {
+			b.ServeFeed(w, req)
+		} else if strings.HasPrefix(req.URL.Path, b.Prefix+postPath) {
 			b.ServePost(w, req)
 		} else if strings.HasPrefix(req.URL.Path, b.Prefix+archivePath) {
 			b.ServeArchive(w, req)
-		} else if strings.HasPrefix(req.URL.Path, b.Prefix+b.staticDir) {
+		} else if strings.HasPrefix(req.URL.Path, b.Prefix+authorPath) {
+			b.ServeAuthor(w, req)
+		} else if strings.HasPrefix(req.URL.Path, b.Prefix+tagPath) {
+			b.ServeTag(w, req)
+		} else if strings.HasPrefix(req.URL.Path, b.Prefix+adminPath+"/") {
+			b.ServeAdmin(w, req)
+		} else if strings.HasPrefix(req.URL.Path, b.Prefix+themePath) {
+			b.ServeThemeAsset(w, req)
+		} else if b.MediaDir != "" && strings.HasPrefix(req.URL.Path, b.Prefix+mediaPath) {
+			http.StripPrefix(b.Prefix+mediaPath, http.FileServer(http.Dir(b.MediaDir))).ServeHTTP(w, req)
+		} else if sitemapMonthRe.MatchString(strings.TrimPrefix(req.URL.Path, b.Prefix)) {
+			b.ServeSitemap(w, req)
+		} else if slugPathRe.MatchString(strings.TrimPrefix(req.URL.Path, b.Prefix)) {
+			b.ServeSlug(w, req)
+		} else if b.staticDir != "" && strings.HasPrefix(req.URL.Path, b.Prefix+b.staticDir) {
 			b.fs.ServeHTTP(w, req)
 		} else {
 			http.NotFound(w, req)
@@ -140,49 +208,42 @@ func (b *Blogplus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// getServerRoot returns the url of the blog. req may be nil
+// outside of requests, in which case b.Scheme and b.Host must be set.
 func getServerRoot(b *Blogplus, req *http.Request) *url.URL {
 	scheme := b.Scheme
-	if scheme == "" {
+	if scheme == "" && req != nil {
 		scheme = req.URL.Scheme
 	}
 	host := b.Host
-	if host == "" {
+	if host == "" && req != nil {
 		host = req.URL.Host
 	}
 	return &url.URL{Scheme: scheme, Host: host, Path: b.Prefix}
 }
 
-func getPostUrl(b *Blogplus, req *http.Request) *url.URL {
-	scheme := b.Scheme
-	if scheme == "" {
-		scheme = req.URL.Scheme
-	}
-	host := b.Host
-	if host == "" {
-		host = req.URL.Host
-	}
-	return &url.URL{Scheme: scheme, Host: host, Path: b.Prefix + postPath}
-}
-
 func (b *Blogplus) ServeMain(w http.ResponseWriter, req *http.Request) {
 	var posts []Activity
-	postUrl := getPostUrl(b, req)
+	serverRoot := getServerRoot(b, req)
 	for _, post := range b.storage.GetLatestPosts(req) {
-		processPost(&post, postUrl)
+		processPost(&post, serverRoot)
+		post.Listed = true
 		posts = append(posts, post)
 	}
 	b.c.MaybeFetch(req)
-	err := BaseTempl.Execute(w,
+	setLastModified(w, posts...)
+	b.executeBase(w,
 		&TemplateContext{
 			Posts: posts, ArchiveItems: b.storage.GetDates(req),
-			ServerRoot: getServerRoot(b, req),
+			TagItems:   tagCloud(b.storage.GetTags(req)),
+			ServerRoot: serverRoot,
 			Title:      b.Title,
+			Home:       true,
 			Blogplus:   b})
-	if err != nil {
-		log.Println("template error:", err)
-	}
 }
 
+// ServePost serves /post/{activityId}. It redirects to the slug permalink
+// if the post has a slug.
 func (b *Blogplus) ServePost(w http.ResponseWriter, req *http.Request) {
 	activityId := path.Base(req.URL.Path)
 	if !activityIdRe.MatchString(activityId) {
@@ -190,36 +251,81 @@ func (b *Blogplus) ServePost(w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 		return
 	}
-	postUrl := getPostUrl(b, req)
 	post, found := b.storage.GetPost(req, activityId)
-	if !found {
+	if !found || post.Override.Hidden {
+		http.NotFound(w, req)
+		return
+	}
+	if b.actorKey != nil {
+		// the url is also the id of the ActivityPub object.
+		w.Header().Set("Vary", "Accept")
+		if wantsActivityJSON(req) {
+			b.serveNote(w, req, post)
+			return
+		}
+	}
+	serverRoot := getServerRoot(b, req)
+	processPost(&post, serverRoot)
+	if post.CurrentSlug() != "" {
+		http.Redirect(w, req, post.Permalink, http.StatusMovedPermanently)
+		return
+	}
+	b.servePost(w, req, post, serverRoot)
+}
+
+// ServeSlug serves /YYYY/MM/slug.
+func (b *Blogplus) ServeSlug(w http.ResponseWriter, req *http.Request) {
+	m := slugPathRe.FindStringSubmatch(strings.TrimPrefix(req.URL.Path, b.Prefix))
+	if m == nil {
 		http.NotFound(w, req)
 		return
 	}
-	processPost(&post, postUrl)
-	b.c.MaybeFetchPost(req, activityId)
-	err := BaseTempl.Execute(w,
+	datespec, slug := m[1]+"-"+m[2], m[3]
+	post, found := b.storage.GetPostBySlug(req, datespec, slug)
+	if !found || post.Override.Hidden {
+		http.NotFound(w, req)
+		return
+	}
+	serverRoot := getServerRoot(b, req)
+	processPost(&post, serverRoot)
+	if post.CurrentSlug() != slug {
+		http.Redirect(w, req, post.Permalink, http.StatusMovedPermanently)
+		return
+	}
+	b.servePost(w, req, post, serverRoot)
+}
+
+func (b *Blogplus) servePost(w http.ResponseWriter, req *http.Request, post Activity, serverRoot *url.URL) {
+	b.c.MaybeFetchPost(req, post.Id)
+	setLastModified(w, post)
+	if b.Webmention {
+		post.Mentions = approvedMentions(b.storage.GetMentions(req, post.Id))
+	}
+	b.executeBase(w,
 		&TemplateContext{
 			Post: post, ArchiveItems: b.storage.GetDates(req),
-			ServerRoot: getServerRoot(b, req),
+			TagItems:   tagCloud(b.storage.GetTags(req)),
+			ServerRoot: serverRoot,
 			Title:      b.Title + " " + post.Title,
 			Blogplus:   b})
-	if err != nil {
-		log.Println("template error:", err)
-	}
 }
 
+// ServeArchive serves /archive/{datespec} and its feed /archive/{datespec}/feed,
+// where datespec is a month "YYYY-MM" or a year "YYYY".
 func (b *Blogplus) ServeArchive(w http.ResponseWriter, req *http.Request) {
-	datespec := path.Base(req.URL.Path)
+	datespec := strings.TrimPrefix(req.URL.Path, b.Prefix+archivePath)
+	feed := strings.HasSuffix(datespec, atomFeedPath)
+	datespec = strings.TrimSuffix(datespec, atomFeedPath)
 	if !dateSpecRe.MatchString(datespec) {
 		log.Println("unexpected datespec:", datespec)
 		http.NotFound(w, req)
 		return
 	}
-	postUrl := getPostUrl(b, req)
+	serverRoot := getServerRoot(b, req)
 	var posts []Activity
 	for _, post := range b.storage.GetArchivedPosts(req, datespec) {
-		processPost(&post, postUrl)
+		processPost(&post, serverRoot)
+		post.Listed = true
 		posts = append(posts, post)
 	}
 	if len(posts) == 0 {
@@ -227,40 +333,154 @@ func (b *Blogplus) ServeArchive(w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 		return
 	}
-	err := BaseTempl.Execute(w,
+	if feed {
+		b.serveAtomFeed(w, req, posts, archivePath+datespec+atomFeedPath)
+		return
+	}
+	setLastModified(w, posts...)
+	b.executeBase(w,
 		&TemplateContext{
 			Posts: posts, ArchiveItems: b.storage.GetDates(req),
-			ServerRoot: getServerRoot(b, req),
-			Title:      b.Title,
+			TagItems:   tagCloud(b.storage.GetTags(req)),
+			ServerRoot: serverRoot,
+			Title:      b.Title + " " + datespec,
+			FeedPath:   archivePath + datespec + atomFeedPath,
+			Archive:    datespec,
 			Blogplus:   b})
-	if err != nil {
-		log.Println("template error:", err)
-	}
 }
 
+// feedPageSize is the number of entries in a page of the paged feed.
+const feedPageSize = 10
+
+// ServeFeed serves the feed of the latest posts, in Atom, RSS 2.0
+// or JSON Feed by the path. The atom feed is also served as RFC 5005
+// paged feed, /feed-page/{n}, and complete feed, /feed-full.
+// Posts are in published order, regardless of pins, so that pages of
+// the paged feed don't overlap.
 func (b *Blogplus) ServeFeed(w http.ResponseWriter, req *http.Request) {
-	postUrl := getPostUrl(b, req)
-	globalUpdated := ""
+	serverRoot := getServerRoot(b, req)
+	p := strings.TrimPrefix(req.URL.Path, b.Prefix)
 	var posts []Activity
-	for _, post := range b.storage.GetLatestPosts(req) {
-		processPost(&post, postUrl)
-		posts = append(posts, post)
+	switch {
+	case p == fullFeedPath:
+		posts = GetAllPosts(b.storage, req)
+	case strings.HasPrefix(p, feedPagePath):
+		page, err := strconv.Atoi(strings.TrimPrefix(p, feedPagePath))
+		if err != nil || page < 1 {
+			http.NotFound(w, req)
+			return
+		}
+		if page == 1 {
+			http.Redirect(w, req, serverRoot.String()+atomFeedPath, http.StatusMovedPermanently)
+			return
+		}
+		posts = b.storage.GetPagedPosts(req, (page-1)*feedPageSize, feedPageSize)
+		if len(posts) == 0 {
+			http.NotFound(w, req)
+			return
+		}
+	default:
+		posts = b.storage.GetPagedPosts(req, 0, feedPageSize)
+	}
+	for i := range posts {
+		processPost(&posts[i], serverRoot)
+	}
+	switch p {
+	case atomFeedPath, rssFeedPath, jsonFeedPath:
+		b.setHubLink(w, req, p)
+	}
+	switch p {
+	case rssFeedPath:
+		b.serveFeed(w, req, posts, "application/rss+xml", GetRSSFeed)
+	case jsonFeedPath:
+		b.serveFeed(w, req, posts, "application/feed+json", GetJSONFeed)
+	case fullFeedPath:
+		b.serveAtomFeedContext(w, req, &TemplateContext{
+			Posts:        posts,
+			FeedPath:     fullFeedPath,
+			FeedComplete: true})
+	default:
+		tc := &TemplateContext{
+			Posts:        posts,
+			FeedPage:     1,
+			FeedLastPage: b.feedLastPage(req)}
+		if p != atomFeedPath {
+			tc.FeedPath = p
+			tc.FeedPage, _ = strconv.Atoi(strings.TrimPrefix(p, feedPagePath))
+		}
+		b.serveAtomFeedContext(w, req, tc)
+	}
+}
+
+// feedLastPage returns the number of pages of the paged feed.
+func (b *Blogplus) feedLastPage(req *http.Request) int {
+	n := 0
+	for _, item := range b.storage.GetDates(req) {
+		n += item.Count
+	}
+	if n == 0 {
+		return 1
+	}
+	return (n + feedPageSize - 1) / feedPageSize
+}
+
+func (b *Blogplus) serveFeed(w http.ResponseWriter, req *http.Request, posts []Activity, contentType string, getFeed func(*TemplateContext) ([]byte, error)) {
+	globalUpdated := ""
+	for _, post := range posts {
 		if globalUpdated < post.Updated {
 			globalUpdated = post.Updated
 		}
 	}
-	w.Header().Set("Content-Type", "application/atom+xml")
-	_, err := io.WriteString(w, xml.Header)
-	if err != nil {
-		log.Println("servefeed:", err)
-	}
-	data, err := GetAtomFeed(
+	data, err := getFeed(
 		&TemplateContext{
 			Posts:         posts,
 			ServerRoot:    getServerRoot(b, req),
 			Title:         b.Title,
 			GlobalUpdated: globalUpdated,
 			Blogplus:      b})
+	if err != nil {
+		log.Println("feed error:", err)
+		http.Error(w, "feed error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	setLastModified(w, posts...)
+	if contentType != "application/feed+json" {
+		_, err = io.WriteString(w, xml.Header)
+		if err != nil {
+			log.Println("servefeed:", err)
+		}
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		log.Println("feed write error:", err)
+	}
+}
+
+func (b *Blogplus) serveAtomFeed(w http.ResponseWriter, req *http.Request, posts []Activity, feedPath string) {
+	b.serveAtomFeedContext(w, req, &TemplateContext{
+		Posts:    posts,
+		FeedPath: feedPath})
+}
+
+// serveAtomFeedContext serves the atom feed of tc.Posts. Fields of tc
+// for all feeds are filled here.
+func (b *Blogplus) serveAtomFeedContext(w http.ResponseWriter, req *http.Request, tc *TemplateContext) {
+	for _, post := range tc.Posts {
+		if tc.GlobalUpdated < post.Updated {
+			tc.GlobalUpdated = post.Updated
+		}
+	}
+	tc.ServerRoot = getServerRoot(b, req)
+	tc.Title = b.Title
+	tc.Blogplus = b
+	w.Header().Set("Content-Type", "application/atom+xml")
+	setLastModified(w, tc.Posts...)
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		log.Println("servefeed:", err)
+	}
+	data, err := GetAtomFeed(tc)
 	if err != nil {
 		log.Println("atom feed error:", err)
 	}
@@ -270,14 +490,81 @@ func (b *Blogplus) ServeFeed(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (b *Blogplus) ServeForceFetch(w http.ResponseWriter, req *http.Request) {
-	b.c.ForceFetch(req)
-	http.Redirect(w, req, b.Prefix+mainPath, http.StatusFound)
+// ServeAuthor serves /author/{actorId} and its feed /author/{actorId}/feed.
+func (b *Blogplus) ServeAuthor(w http.ResponseWriter, req *http.Request) {
+	actorId := strings.TrimPrefix(req.URL.Path, b.Prefix+authorPath)
+	feed := strings.HasSuffix(actorId, atomFeedPath)
+	actorId = strings.TrimSuffix(actorId, atomFeedPath)
+	if !actorIdRe.MatchString(actorId) {
+		log.Println("unexpected actorId:", actorId)
+		http.NotFound(w, req)
+		return
+	}
+	serverRoot := getServerRoot(b, req)
+	var posts []Activity
+	for _, post := range b.storage.GetAuthorPosts(req, actorId) {
+		processPost(&post, serverRoot)
+		post.Listed = true
+		posts = append(posts, post)
+	}
+	if len(posts) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	if feed {
+		b.serveAtomFeed(w, req, posts, authorPath+actorId+atomFeedPath)
+		return
+	}
+	setLastModified(w, posts...)
+	b.executeBase(w,
+		&TemplateContext{
+			Posts: posts, ArchiveItems: b.storage.GetDates(req),
+			TagItems:   tagCloud(b.storage.GetTags(req)),
+			ServerRoot: serverRoot,
+			Title:      b.Title + " " + posts[0].Actor.DisplayName,
+			FeedPath:   authorPath + actorId + atomFeedPath,
+			Blogplus:   b})
+}
+
+// ServeTag serves /tag/{tag} and its feed /tag/{tag}/feed.
+func (b *Blogplus) ServeTag(w http.ResponseWriter, req *http.Request) {
+	tag := strings.TrimPrefix(req.URL.Path, b.Prefix+tagPath)
+	feed := strings.HasSuffix(tag, atomFeedPath)
+	tag = NormalizeTag(strings.TrimSuffix(tag, atomFeedPath))
+	if !tagRe.MatchString(tag) {
+		log.Println("unexpected tag:", tag)
+		http.NotFound(w, req)
+		return
+	}
+	serverRoot := getServerRoot(b, req)
+	var posts []Activity
+	for _, post := range b.storage.GetTaggedPosts(req, tag) {
+		processPost(&post, serverRoot)
+		post.Listed = true
+		posts = append(posts, post)
+	}
+	if len(posts) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	if feed {
+		b.serveAtomFeed(w, req, posts, tagPath+url.PathEscape(tag)+atomFeedPath)
+		return
+	}
+	setLastModified(w, posts...)
+	b.executeBase(w,
+		&TemplateContext{
+			Posts: posts, ArchiveItems: b.storage.GetDates(req),
+			TagItems:   tagCloud(b.storage.GetTags(req)),
+			ServerRoot: serverRoot,
+			Title:      b.Title + " #" + tag,
+			FeedPath:   tagPath + url.PathEscape(tag) + atomFeedPath,
+			Blogplus:   b})
 }
 
 func (b *Blogplus) ServeArchivesJs(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "text/javascript")
-	err := ArchivesJsTempl.Execute(w,
+	err := b.templates().archivesJs.Execute(w,
 		&TemplateContext{
 			ServerRoot: getServerRoot(b, req),
 			Blogplus:   b})
@@ -0,0 +1,75 @@
+package blogplus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testController struct{}
+
+func (testController) ForceFetch(req *http.Request)                        {}
+func (testController) MaybeFetch(req *http.Request)                        {}
+func (testController) MaybeFetchPost(req *http.Request, activityId string) {}
+func (testController) Status(req *http.Request) FetchStatus                { return FetchStatus{} }
+
+// newTestBlogplus returns a blog at http://example.com on a MemStorage.
+func newTestBlogplus() (*Blogplus, *MemStorage) {
+	s := NewMemStorage()
+	b := NewBlogplus(s, testController{})
+	b.Title = "Test blog"
+	b.Scheme = "http"
+	b.Host = "example.com"
+	return b, s
+}
+
+// testPost returns a post published at t, long enough for the default filter.
+func testPost(id string, t time.Time, content string) Activity {
+	d := t.UTC().Format(time.RFC3339)
+	return Activity{
+		Id:        id,
+		Published: d,
+		Updated:   d,
+		Verb:      "post",
+		Actor:     Actor{Id: "111", DisplayName: "Alice", Url: "http://alice.example.com/"},
+		Object:    Object{Content: content + " " + strings.Repeat("padding ", 30)},
+	}
+}
+
+// waitFor polls cond until it is true, or fails t after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPageTitles(t *testing.T) {
+	b, s := newTestBlogplus()
+	s.StorePosts(nil, []Activity{testPost("pt1", time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC), "Titled post #golang")})
+	for _, tc := range []struct{ path, title string }{
+		{"/", "<title>Test blog</title>"},
+		{"/archive/2020-01", "<title>Test blog 2020-01</title>"},
+		{"/author/111", "<title>Test blog Alice</title>"},
+		{"/tag/golang", "<title>Test blog #golang</title>"},
+	} {
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com"+tc.path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: %d", tc.path, w.Code)
+			continue
+		}
+		if !strings.Contains(w.Body.String(), tc.title) {
+			t.Errorf("GET %s: no %s", tc.path, tc.title)
+		}
+		if strings.Contains(w.Body.String(), "Test blogTest blog") {
+			t.Errorf("GET %s: the blog title is repeated", tc.path)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package blogplus
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HTTP Signatures, as used by ActivityPub servers:
+// https://tools.ietf.org/html/draft-cavage-http-signatures-12
+
+// maxClockSkew limits the difference of Date header of signed requests.
+const maxClockSkew = 12 * time.Hour
+
+var signatureParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// digest returns the value of Digest header for body.
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func signingString(req *http.Request, headers []string) string {
+	var lines []string
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, h+": "+strings.ToLower(req.Method)+" "+req.URL.RequestURI())
+		case "host":
+			host := req.Host
+			if host == "" {
+				host = req.URL.Host
+			}
+			lines = append(lines, h+": "+host)
+		default:
+			lines = append(lines, h+": "+strings.Join(req.Header[http.CanonicalHeaderKey(h)], ", "))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// signRequest signs req with key. body is the request body, or nil for GET.
+func signRequest(req *http.Request, body []byte, keyId string, key *rsa.PrivateKey) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		req.Header.Set("Digest", digest(body))
+		headers = append(headers, "digest")
+	}
+	hashed := sha256.Sum256([]byte(signingString(req, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyId, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// verifyRequest verifies the signature of req with body.
+// publicKey returns the key for keyId and its owner.
+// It returns the owner of the key.
+func verifyRequest(req *http.Request, body []byte, publicKey func(keyId string) (*rsa.PublicKey, string, error)) (string, error) {
+	params := make(map[string]string)
+	for _, m := range signatureParamRe.FindAllStringSubmatch(req.Header.Get("Signature"), -1) {
+		params[m[1]] = m[2]
+	}
+	keyId := params["keyId"]
+	if keyId == "" || params["signature"] == "" {
+		return "", errors.New("no signature")
+	}
+	if alg := params["algorithm"]; alg != "" && alg != "rsa-sha256" && alg != "hs2019" {
+		return "", fmt.Errorf("unsupported algorithm: %s", alg)
+	}
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	signed := make(map[string]bool)
+	for _, h := range headers {
+		signed[h] = true
+	}
+	if !signed["(request-target)"] || !signed["date"] {
+		return "", errors.New("(request-target) and date must be signed")
+	}
+	if body != nil {
+		if !signed["digest"] {
+			return "", errors.New("digest must be signed")
+		}
+		if req.Header.Get("Digest") != digest(body) {
+			return "", errors.New("digest mismatch")
+		}
+	}
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return "", err
+	}
+	if d := time.Since(date); d > maxClockSkew || d < -maxClockSkew {
+		return "", errors.New("date out of range")
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return "", err
+	}
+	key, owner, err := publicKey(keyId)
+	if err != nil {
+		return "", err
+	}
+	hashed := sha256.Sum256([]byte(signingString(req, headers)))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig)
+	if err != nil {
+		return "", err
+	}
+	return owner, nil
+}
@@ -0,0 +1,129 @@
+package blogplus
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+)
+
+// PageMeta is the metadata of a page for link previews:
+// Open Graph, Twitter Card and schema.org JSON-LD.
+type PageMeta struct {
+	Type        string // og:type
+	Title       string
+	Description string
+	Url         string
+	Image       string
+}
+
+// JSON-LD types of schema.org.
+
+type ldPerson struct {
+	Type string `json:"@type"`
+	Name string `json:"name,omitempty"`
+	Url  string `json:"url,omitempty"`
+}
+
+type ldBlogPosting struct {
+	Context          string   `json:"@context"`
+	Type             string   `json:"@type"`
+	Headline         string   `json:"headline"`
+	Description      string   `json:"description,omitempty"`
+	Url              string   `json:"url"`
+	MainEntityOfPage string   `json:"mainEntityOfPage"`
+	DatePublished    string   `json:"datePublished"`
+	DateModified     string   `json:"dateModified,omitempty"`
+	Author           ldPerson `json:"author"`
+	Image            string   `json:"image,omitempty"`
+	Keywords         []string `json:"keywords,omitempty"`
+}
+
+type ldWebSite struct {
+	Context string    `json:"@context"`
+	Type    string    `json:"@type"`
+	Name    string    `json:"name"`
+	Url     string    `json:"url"`
+	Author  *ldPerson `json:"author,omitempty"`
+	Image   string    `json:"image,omitempty"`
+}
+
+// postImage returns the image of the first photo attachment of post, or "".
+func postImage(post Activity) string {
+	for _, attachment := range post.Object.Attachments {
+		if attachment.ObjectType == "photo" && attachment.Image.Url != "" {
+			return attachment.Image.Url
+		}
+	}
+	return ""
+}
+
+// isPostPage reports whether tc is for a post page.
+func (tc *TemplateContext) isPostPage() bool {
+	return len(tc.Posts) == 0 && tc.Post.Id != ""
+}
+
+// Meta returns the metadata of the post page or the home page, or nil.
+func (tc *TemplateContext) Meta() *PageMeta {
+	switch {
+	case tc.isPostPage():
+		return &PageMeta{
+			Type:        "article",
+			Title:       tc.Post.Object.Subject,
+			Description: tc.Post.Object.Excerpt,
+			Url:         tc.Post.Permalink,
+			Image:       postImage(tc.Post)}
+	case tc.Home:
+		return &PageMeta{
+			Type:  "website",
+			Title: tc.Blogplus.Title,
+			Url:   tc.ServerRoot.String() + mainPath,
+			Image: tc.Blogplus.LogoUrl}
+	}
+	return nil
+}
+
+// JSONLD returns the schema.org BlogPosting of the post page, or WebSite
+// of the home page, for <script type="application/ld+json">.
+func (tc *TemplateContext) JSONLD() template.JS {
+	var v interface{}
+	switch {
+	case tc.isPostPage():
+		post := tc.Post
+		author := ldPerson{Type: "Person", Name: post.Actor.DisplayName, Url: post.Actor.Url}
+		if author.Name == "" {
+			author.Name, author.Url = tc.Blogplus.AuthorName, tc.Blogplus.AuthorUri
+		}
+		v = ldBlogPosting{
+			Context:          "https://schema.org",
+			Type:             "BlogPosting",
+			Headline:         post.Object.Subject,
+			Description:      post.Object.Excerpt,
+			Url:              post.Permalink,
+			MainEntityOfPage: post.Permalink,
+			DatePublished:    post.Published,
+			DateModified:     post.Updated,
+			Author:           author,
+			Image:            postImage(post),
+			Keywords:         post.Object.Tags}
+	case tc.Home:
+		site := ldWebSite{
+			Context: "https://schema.org",
+			Type:    "WebSite",
+			Name:    tc.Blogplus.Title,
+			Url:     tc.ServerRoot.String() + mainPath,
+			Image:   tc.Blogplus.LogoUrl}
+		if tc.Blogplus.AuthorName != "" {
+			site.Author = &ldPerson{Type: "Person", Name: tc.Blogplus.AuthorName, Url: tc.Blogplus.AuthorUri}
+		}
+		v = site
+	default:
+		return ""
+	}
+	// json.Marshal escapes <, > and &, so that it can't close the script.
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("json-ld error:", err)
+		return ""
+	}
+	return template.JS(data)
+}
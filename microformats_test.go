@@ -0,0 +1,247 @@
+package blogplus
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// mf2Item is a microformats2 item parsed by parseMF2.
+type mf2Item struct {
+	Type       []string
+	Properties map[string][]interface{} // string or *mf2Item
+	Children   []*mf2Item
+}
+
+// parseMF2 returns the top level microformats2 items in doc. It implements
+// the parts of http://microformats.org/wiki/microformats2-parsing used by
+// the themes: explicit p-, u-, dt- and e- properties, and nested items.
+func parseMF2(doc *html.Node) []*mf2Item {
+	var items []*mf2Item
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			if types := mf2Types(c); len(types) > 0 {
+				items = append(items, parseMF2Item(c, types))
+				continue
+			}
+			walk(c)
+		}
+	}
+	walk(doc)
+	return items
+}
+
+func parseMF2Item(n *html.Node, types []string) *mf2Item {
+	item := &mf2Item{Type: types, Properties: make(map[string][]interface{})}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			var props []string
+			for _, prefix := range []string{"p-", "u-", "dt-", "e-"} {
+				for _, name := range mf2Classes(c, prefix) {
+					props = append(props, prefix+name)
+				}
+			}
+			if types := mf2Types(c); len(types) > 0 {
+				nested := parseMF2Item(c, types)
+				if len(props) == 0 {
+					item.Children = append(item.Children, nested)
+				}
+				for _, prop := range props {
+					name := prop[strings.Index(prop, "-")+1:]
+					item.Properties[name] = append(item.Properties[name], nested)
+				}
+				continue
+			}
+			for _, prop := range props {
+				name := prop[strings.Index(prop, "-")+1:]
+				item.Properties[name] = append(item.Properties[name], mf2Value(c, prop[:strings.Index(prop, "-")]))
+			}
+			walk(c)
+		}
+	}
+	walk(n)
+	return item
+}
+
+// mf2Types returns the h-* classes of n.
+func mf2Types(n *html.Node) []string {
+	var types []string
+	for _, name := range mf2Classes(n, "h-") {
+		types = append(types, "h-"+name)
+	}
+	return types
+}
+
+// mf2Classes returns the names of classes of n with prefix, without prefix.
+func mf2Classes(n *html.Node, prefix string) []string {
+	var names []string
+	for _, class := range strings.Fields(attr(n, "class")) {
+		if strings.HasPrefix(class, prefix) && len(class) > len(prefix) {
+			names = append(names, strings.TrimPrefix(class, prefix))
+		}
+	}
+	return names
+}
+
+func mf2Value(n *html.Node, kind string) string {
+	switch kind {
+	case "u":
+		switch n.DataAtom {
+		case atom.A, atom.Link:
+			return attr(n, "href")
+		case atom.Img, atom.Audio, atom.Video, atom.Source:
+			return attr(n, "src")
+		}
+	case "dt":
+		switch n.DataAtom {
+		case atom.Time, atom.Ins, atom.Del:
+			if v := attr(n, "datetime"); v != "" {
+				return v
+			}
+		}
+	case "e":
+		var buf bytes.Buffer
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			html.Render(&buf, c)
+		}
+		return strings.TrimSpace(buf.String())
+	}
+	switch n.DataAtom {
+	case atom.Data:
+		return attr(n, "value")
+	case atom.Img, atom.Area:
+		if kind == "p" {
+			return attr(n, "alt")
+		}
+	}
+	return strings.TrimSpace(textContent(n))
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var s strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		s.WriteString(textContent(c))
+	}
+	return s.String()
+}
+
+// findMF2 returns the items of type in items and their children.
+func findMF2(items []*mf2Item, typ string) []*mf2Item {
+	var found []*mf2Item
+	for _, item := range items {
+		for _, t := range item.Type {
+			if t == typ {
+				found = append(found, item)
+			}
+		}
+		found = append(found, findMF2(item.Children, typ)...)
+	}
+	return found
+}
+
+func (item *mf2Item) strings(name string) []string {
+	var values []string
+	for _, v := range item.Properties[name] {
+		if s, ok := v.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+func TestMicroformats(t *testing.T) {
+	b, s := newTestBlogplus()
+	post := testPost("mf1", time.Date(2012, 5, 1, 10, 20, 30, 0, time.UTC), "Hello microformats. Tagged #golang post.")
+	post.Actor.Image.Url = "http://alice.example.com/avatar.png"
+	post.Object.Attachments = []Attachment{{
+		ObjectType: "photo",
+		Url:        "http://photos.example.com/album/1",
+		Image:      Image{Url: "http://photos.example.com/1.jpg"}}}
+	s.StorePosts(nil, []Activity{post})
+	stored, found := s.GetPost(nil, "mf1")
+	if !found {
+		t.Fatal("post is not stored")
+	}
+	processPost(&stored, getServerRoot(b, nil))
+
+	for _, p := range []string{stored.Permalink, "http://example.com/"} {
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d", p, w.Code)
+		}
+		doc, err := html.Parse(w.Body)
+		if err != nil {
+			t.Fatalf("GET %s: %v", p, err)
+		}
+		entries := findMF2(parseMF2(doc), "h-entry")
+		if len(entries) != 1 {
+			t.Fatalf("GET %s: %d h-entry; want 1", p, len(entries))
+		}
+		e := entries[0]
+		check := func(name string, want string) {
+			t.Helper()
+			for _, v := range e.strings(name) {
+				if v == want {
+					return
+				}
+			}
+			t.Errorf("GET %s: %s=%q; want %q", p, name, e.strings(name), want)
+		}
+		check("name", "Hello microformats.")
+		check("published", "2012-05-01T10:20:30Z")
+		check("url", stored.Permalink)
+		check("photo", "http://photos.example.com/1.jpg")
+		check("category", "golang")
+		if content := e.strings("content"); len(content) != 1 || !strings.Contains(content[0], "Hello microformats.") {
+			t.Errorf("GET %s: content=%q", p, content)
+		}
+		if photos := e.strings("photo"); len(photos) != 1 {
+			t.Errorf("GET %s: photo=%q; want the attachment only, not the avatar", p, photos)
+		}
+
+		authors := e.Properties["author"]
+		if len(authors) != 1 {
+			t.Fatalf("GET %s: %d authors; want 1", p, len(authors))
+		}
+		author, ok := authors[0].(*mf2Item)
+		if !ok || len(author.Type) != 1 || author.Type[0] != "h-card" {
+			t.Fatalf("GET %s: author %#v; want h-card", p, authors[0])
+		}
+		if got := author.strings("name"); len(got) != 1 || got[0] != "Alice" {
+			t.Errorf("GET %s: author name=%q", p, got)
+		}
+		if got := author.strings("url"); len(got) != 1 || got[0] != "http://example.com/author/111" {
+			t.Errorf("GET %s: author url=%q", p, got)
+		}
+		if got := author.strings("photo"); len(got) != 1 || got[0] != "http://alice.example.com/avatar.png" {
+			t.Errorf("GET %s: author photo=%q", p, got)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package blogplus
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Micropub: https://www.w3.org/TR/micropub/
+
+const (
+	micropubPath = "/micropub"
+	mediaPath    = "/media/"
+
+	maxMediaSize = 20 << 20
+)
+
+// mediaTypes maps types of media accepted by Micropub, as sniffed by
+// http.DetectContentType, to their extensions. Others, such as HTML and
+// SVG, may run scripts when served from the blog.
+var mediaTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/bmp":       ".bmp",
+	"image/x-icon":    ".ico",
+	"audio/mpeg":      ".mp3",
+	"audio/wave":      ".wav",
+	"audio/aiff":      ".aiff",
+	"audio/midi":      ".mid",
+	"audio/basic":     ".au",
+	"application/ogg": ".ogg",
+	"video/mp4":       ".mp4",
+	"video/webm":      ".webm",
+	"video/avi":       ".avi",
+}
+
+var errUnsupportedMedia = errors.New("unsupported media type")
+
+// EntrySource is the h-entry properties of a post created by Micropub.
+// The content of the post is formed from it, and it is returned by q=source.
+type EntrySource struct {
+	Name       string
+	Content    string
+	HTML       bool // Content is HTML
+	Categories []string
+	Photos     []string
+	Published  string
+}
+
+// apply forms the content and attachments of post from e.
+func (e *EntrySource) apply(post *Activity) {
+	var content string
+	if e.Name != "" {
+		content = "<b>" + html.EscapeString(e.Name) + "</b><br /><br />"
+	}
+	if e.HTML {
+		content += e.Content
+	} else {
+		content += strings.Replace(html.EscapeString(e.Content), "\n", "<br />", -1)
+	}
+	// categories are hashtags in blogplus.
+	tags := extractTags(content)
+	var hashtags []string
+	for _, c := range e.Categories {
+		tag := NormalizeTag(c)
+		if tag != "" && !hasAnyTag(tags, []string{tag}) {
+			hashtags = append(hashtags, "#"+html.EscapeString(tag))
+		}
+	}
+	if len(hashtags) > 0 {
+		content += "<br /><br />" + strings.Join(hashtags, " ")
+	}
+	post.Title = e.Name
+	post.Object.Content = content
+	post.Object.Attachments = nil
+	for _, photo := range e.Photos {
+		post.Object.Attachments = append(post.Object.Attachments, Attachment{
+			ObjectType: "photo",
+			Url:        photo,
+			Image:      Image{Url: photo}})
+	}
+}
+
+// properties returns e as microformats2 properties.
+func (e *EntrySource) properties() map[string][]interface{} {
+	props := make(map[string][]interface{})
+	if e.Name != "" {
+		props["name"] = []interface{}{e.Name}
+	}
+	if e.HTML {
+		props["content"] = []interface{}{map[string]string{"html": e.Content}}
+	} else if e.Content != "" {
+		props["content"] = []interface{}{e.Content}
+	}
+	for _, c := range e.Categories {
+		props["category"] = append(props["category"], c)
+	}
+	for _, p := range e.Photos {
+		props["photo"] = append(props["photo"], p)
+	}
+	if e.Published != "" {
+		props["published"] = []interface{}{e.Published}
+	}
+	return props
+}
+
+// mf2Values converts JSON values of a property to strings.
+// content may be {"html": ...}, and photo may be {"value": ...}.
+func mf2Values(values []json.RawMessage) (strs []string, isHTML bool) {
+	for _, v := range values {
+		var s string
+		if json.Unmarshal(v, &s) == nil {
+			strs = append(strs, s)
+			continue
+		}
+		var o struct {
+			HTML  *string `json:"html"`
+			Value string  `json:"value"`
+		}
+		if json.Unmarshal(v, &o) == nil {
+			if o.HTML != nil {
+				strs = append(strs, *o.HTML)
+				isHTML = true
+			} else {
+				strs = append(strs, o.Value)
+			}
+		}
+	}
+	return strs, isHTML
+}
+
+// setProperty sets property name of e to values.
+func (e *EntrySource) setProperty(name string, values []string, isHTML bool) {
+	first := ""
+	if len(values) > 0 {
+		first = values[0]
+	}
+	switch name {
+	case "name":
+		e.Name = first
+	case "content":
+		e.Content, e.HTML = first, isHTML
+	case "category":
+		e.Categories = values
+	case "photo":
+		e.Photos = values
+	case "published":
+		e.Published = first
+	}
+}
+
+func (e *EntrySource) getProperty(name string) []string {
+	switch name {
+	case "category":
+		return e.Categories
+	case "photo":
+		return e.Photos
+	}
+	return nil
+}
+
+// micropubRequest is a Micropub request in JSON.
+type micropubRequest struct {
+	Type       []string                     `json:"type"`
+	Properties map[string][]json.RawMessage `json:"properties"`
+	Action     string                       `json:"action"`
+	Url        string                       `json:"url"`
+	Replace    map[string][]json.RawMessage `json:"replace"`
+	Add        map[string][]json.RawMessage `json:"add"`
+	Delete     json.RawMessage              `json:"delete"`
+}
+
+func micropubError(w http.ResponseWriter, code int, err, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             err,
+		"error_description": description})
+}
+
+func micropubJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("micropub write error:", err)
+	}
+}
+
+// micropubAuthorized checks the bearer token in req.
+func (b *Blogplus) micropubAuthorized(req *http.Request) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == req.Header.Get("Authorization") {
+		token = req.FormValue("access_token")
+	}
+	if token == "" {
+		return false
+	}
+	for _, t := range b.MicropubTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeMicropub serves the Micropub endpoint and its media endpoint.
+// It is disabled unless MicropubTokens is set.
+func (b *Blogplus) ServeMicropub(w http.ResponseWriter, req *http.Request) {
+	if len(b.MicropubTokens) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method == "POST" {
+		req.Body = http.MaxBytesReader(w, req.Body, maxMediaSize)
+	}
+	if !b.micropubAuthorized(req) {
+		micropubError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid access token")
+		return
+	}
+	if strings.TrimPrefix(req.URL.Path, b.Prefix) == micropubPath+mediaPath {
+		b.serveMedia(w, req)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		b.serveMicropubQuery(w, req)
+	case "POST":
+		b.serveMicropubPost(w, req)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (b *Blogplus) serveMicropubQuery(w http.ResponseWriter, req *http.Request) {
+	serverRoot := getServerRoot(b, req)
+	switch req.FormValue("q") {
+	case "config":
+		config := map[string]interface{}{"syndicate-to": []string{}}
+		if b.MediaDir != "" {
+			config["media-endpoint"] = serverRoot.String() + micropubPath + mediaPath
+		}
+		micropubJSON(w, config)
+	case "syndicate-to":
+		micropubJSON(w, map[string]interface{}{"syndicate-to": []string{}})
+	case "source":
+		post, found := b.lookupPost(req, req.FormValue("url"))
+		if !found || post.Source == nil {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "unknown url")
+			return
+		}
+		props := post.Source.properties()
+		if names := req.Form["properties[]"]; len(names) > 0 {
+			selected := make(map[string][]interface{})
+			for _, name := range names {
+				if v, ok := props[name]; ok {
+					selected[name] = v
+				}
+			}
+			micropubJSON(w, map[string]interface{}{"properties": selected})
+			return
+		}
+		micropubJSON(w, map[string]interface{}{
+			"type":       []string{"h-entry"},
+			"properties": props})
+	default:
+		micropubError(w, http.StatusBadRequest, "invalid_request", "unsupported query")
+	}
+}
+
+func (b *Blogplus) serveMicropubPost(w http.ResponseWriter, req *http.Request) {
+	var mr micropubRequest
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(io.LimitReader(req.Body, maxFetchSize)).Decode(&mr)
+		if err != nil {
+			micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+	} else {
+		err := req.ParseMultipartForm(maxMediaSize)
+		if err != nil && err != http.ErrNotMultipart {
+			micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		mr = b.formRequest(w, req)
+	}
+	switch mr.Action {
+	case "":
+		if len(mr.Type) > 0 && mr.Type[0] != "h-entry" {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "only h-entry is supported")
+			return
+		}
+		b.micropubCreate(w, req, mr)
+	case "update":
+		b.micropubUpdate(w, req, mr)
+	case "delete", "undelete":
+		post, found := b.lookupPost(req, mr.Url)
+		if !found {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "unknown url")
+			return
+		}
+		o := post.Override
+		o.Hidden = mr.Action == "delete"
+		err := b.storage.SetOverride(req, post.Id, o)
+		if err != nil {
+			micropubError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		b.cache.flush()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		micropubError(w, http.StatusBadRequest, "invalid_request", "unsupported action")
+	}
+}
+
+// formRequest converts a form-encoded or multipart request to micropubRequest.
+// uploaded photos are saved as media.
+func (b *Blogplus) formRequest(w http.ResponseWriter, req *http.Request) micropubRequest {
+	mr := micropubRequest{
+		Action:     req.PostFormValue("action"),
+		Url:        req.PostFormValue("url"),
+		Properties: make(map[string][]json.RawMessage)}
+	if h := req.PostFormValue("h"); h != "" {
+		mr.Type = []string{"h-" + h}
+	}
+	for key, values := range req.PostForm {
+		key = strings.TrimSuffix(key, "[]")
+		if key == "h" || key == "action" || key == "url" || key == "access_token" {
+			continue
+		}
+		for _, v := range values {
+			data, _ := json.Marshal(v)
+			mr.Properties[key] = append(mr.Properties[key], data)
+		}
+	}
+	if req.MultipartForm != nil && b.MediaDir != "" {
+		for _, key := range []string{"photo", "photo[]"} {
+			for _, fh := range req.MultipartForm.File[key] {
+				f, err := fh.Open()
+				if err != nil {
+					log.Println("micropub photo:", err)
+					continue
+				}
+				u, err := b.saveMedia(req, f)
+				f.Close()
+				if err != nil {
+					log.Println("micropub photo:", err)
+					continue
+				}
+				data, _ := json.Marshal(u)
+				mr.Properties["photo"] = append(mr.Properties["photo"], data)
+			}
+		}
+	}
+	return mr
+}
+
+func (b *Blogplus) micropubCreate(w http.ResponseWriter, req *http.Request, mr micropubRequest) {
+	source := &EntrySource{}
+	for name, values := range mr.Properties {
+		strs, isHTML := mf2Values(values)
+		source.setProperty(name, strs, isHTML)
+	}
+	if source.Content == "" && source.Name == "" && len(source.Photos) == 0 {
+		micropubError(w, http.StatusBadRequest, "invalid_request", "no content")
+		return
+	}
+	published := time.Now().UTC().Format(time.RFC3339)
+	if source.Published != "" {
+		t, err := time.Parse(time.RFC3339, source.Published)
+		if err != nil {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "bad published")
+			return
+		}
+		published = t.UTC().Format(time.RFC3339)
+	}
+	post := Activity{
+		Id:        "mp" + randomToken()[:20],
+		Published: published,
+		Updated:   published,
+		Verb:      "post",
+		Actor: Actor{
+			DisplayName: b.AuthorName,
+			Url:         b.AuthorUri},
+		Source: source}
+	source.apply(&post)
+	// mp-slug, or the name rather than the first sentence, made unique
+	// in the month when stored.
+	post.Slug = source.Name
+	if slugs, _ := mf2Values(mr.Properties["mp-slug"]); len(slugs) > 0 {
+		post.Slug = slugs[0]
+	}
+	b.storage.StorePosts(req, []Activity{post})
+	stored, found := b.storage.GetPost(req, post.Id)
+	if !found {
+		rules := b.Filter
+		if rules == nil {
+			rules = &DefaultFilterRules
+		}
+		PreparePost(&post, nil)
+		_, reason := rules.Explain(post)
+		micropubError(w, http.StatusBadRequest, "invalid_request", "rejected by filter: "+reason)
+		return
+	}
+	processPost(&stored, getServerRoot(b, req))
+	w.Header().Set("Location", stored.Permalink)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (b *Blogplus) micropubUpdate(w http.ResponseWriter, req *http.Request, mr micropubRequest) {
+	post, found := b.lookupPost(req, mr.Url)
+	if !found {
+		micropubError(w, http.StatusBadRequest, "invalid_request", "unknown url")
+		return
+	}
+	if post.Source == nil {
+		micropubError(w, http.StatusBadRequest, "invalid_request", "not a micropub post")
+		return
+	}
+	source := *post.Source
+	for name, values := range mr.Replace {
+		strs, isHTML := mf2Values(values)
+		source.setProperty(name, strs, isHTML)
+	}
+	for name, values := range mr.Add {
+		strs, isHTML := mf2Values(values)
+		if name == "category" || name == "photo" {
+			strs = append(source.getProperty(name), strs...)
+		}
+		source.setProperty(name, strs, isHTML)
+	}
+	if len(mr.Delete) > 0 {
+		// either a list of properties or values of properties.
+		var names []string
+		var values map[string][]json.RawMessage
+		if json.Unmarshal(mr.Delete, &names) == nil {
+			for _, name := range names {
+				source.setProperty(name, nil, false)
+			}
+		} else if json.Unmarshal(mr.Delete, &values) == nil {
+			for name, vs := range values {
+				strs, _ := mf2Values(vs)
+				var kept []string
+				for _, v := range source.getProperty(name) {
+					if !contains(strs, v) {
+						kept = append(kept, v)
+					}
+				}
+				source.setProperty(name, kept, false)
+			}
+		} else {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "bad delete")
+			return
+		}
+	}
+	post.Source = &source
+	source.apply(&post)
+	post.Override = Override{}
+	post.Updated = time.Now().UTC().Format(time.RFC3339)
+	b.storage.StorePosts(req, []Activity{post})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveMedia saves r in b.MediaDir and returns its url. The type of media
+// is sniffed from its content, regardless of the filename and the type
+// given by the client, and only images, audio and video are accepted.
+func (b *Blogplus) saveMedia(req *http.Request, r io.Reader) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	head = head[:n]
+	ext, ok := mediaTypes[http.DetectContentType(head)]
+	if !ok {
+		return "", errUnsupportedMedia
+	}
+	name := randomToken()[:24] + ext
+	f, err := os.OpenFile(filepath.Join(b.MediaDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(0644))
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, io.MultiReader(bytes.NewReader(head), r))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return getServerRoot(b, req).String() + path.Join(mediaPath, name), nil
+}
+
+// serveMedia serves the media endpoint.
+func (b *Blogplus) serveMedia(w http.ResponseWriter, req *http.Request) {
+	if b.MediaDir == "" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, _, err := req.FormFile("file")
+	if err != nil {
+		micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	defer f.Close()
+	u, err := b.saveMedia(req, f)
+	if err == errUnsupportedMedia {
+		micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if err != nil {
+		log.Println("media:", err)
+		micropubError(w, http.StatusInternalServerError, "server_error", "failed to save")
+		return
+	}
+	w.Header().Set("Location", u)
+	w.WriteHeader(http.StatusCreated)
+}
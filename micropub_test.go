@@ -0,0 +1,97 @@
+package blogplus
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// 1x1 png.
+var testPNG, _ = base64.StdEncoding.DecodeString("iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==")
+
+func newTestMicropub(t *testing.T) (*Blogplus, *MemStorage) {
+	b, s := newTestBlogplus()
+	b.MicropubTokens = []string{"secret"}
+	dir, err := ioutil.TempDir("", "blogplus-media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.MediaDir = dir
+	s.SetFilter(DefaultFilterRules.Match)
+	return b, s
+}
+
+func postMicropub(b *Blogplus, target, contentType string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "http://example.com"+target, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, req)
+	return w
+}
+
+func TestMicropubMediaTypes(t *testing.T) {
+	b, _ := newTestMicropub(t)
+	defer os.RemoveAll(b.MediaDir)
+	for _, tc := range []struct {
+		filename, contentType string
+		data                  []byte
+		wantExt               string // "" if rejected
+	}{
+		{"x.png", "image/png", testPNG, ".png"},
+		{"x.html", "text/html", testPNG, ".png"},
+		{"x.png", "image/png", []byte("<html><script>alert(1)</script></html>"), ""},
+		{"x.html", "text/html", []byte("<!DOCTYPE html><script>alert(1)</script>"), ""},
+		{"x.svg", "image/svg+xml", []byte(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`), ""},
+		{"x.jpg", "image/jpeg", nil, ""},
+	} {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", tc.filename)
+		fw.Write(tc.data)
+		mw.Close()
+		w := postMicropub(b, "/micropub/media/", mw.FormDataContentType(), body.Bytes())
+		if tc.wantExt == "" {
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s %q: %d; want %d", tc.filename, tc.data, w.Code, http.StatusBadRequest)
+			}
+			continue
+		}
+		loc := w.Header().Get("Location")
+		if w.Code != http.StatusCreated || path.Ext(loc) != tc.wantExt {
+			t.Errorf("%s: %d %q; want %d and %s", tc.filename, w.Code, loc, http.StatusCreated, tc.wantExt)
+		}
+	}
+	files, _ := ioutil.ReadDir(b.MediaDir)
+	if len(files) != 2 {
+		t.Errorf("%d files saved; want 2", len(files))
+	}
+}
+
+func TestMicropubCreate(t *testing.T) {
+	b, s := newTestMicropub(t)
+	defer os.RemoveAll(b.MediaDir)
+	var locs []string
+	for i := 0; i < 2; i++ {
+		form := url.Values{"h": {"entry"}, "content": {"A short note."}, "mp-slug": {"My Note"}}
+		w := postMicropub(b, "/micropub", "application/x-www-form-urlencoded", []byte(form.Encode()))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create: %d %s", w.Code, w.Body)
+		}
+		locs = append(locs, w.Header().Get("Location"))
+	}
+	if !strings.HasSuffix(locs[0], "/my-note") || !strings.HasSuffix(locs[1], "/my-note-2") {
+		t.Errorf("permalinks %q; want .../my-note and .../my-note-2", locs)
+	}
+	if n := len(GetAllPosts(s, nil)); n != 2 {
+		t.Errorf("%d posts stored; want 2", n)
+	}
+}
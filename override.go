@@ -0,0 +1,22 @@
+package blogplus
+
+import "errors"
+
+// ErrSlugTaken is returned by SetOverride if the slug is used by another
+// post in the month.
+var ErrSlugTaken = errors.New("slug is already used in the month")
+
+// ErrBadSlug is returned by SetOverride if the slug is not as MakeSlug
+// makes it, since it would not be a path segment of the permalink.
+var ErrBadSlug = errors.New("slug must be as made by MakeSlug")
+
+// Override is a manual moderation setting of a post.
+// It is stored separately from the post, so it survives re-fetches.
+// Slugs of overrides are recorded as generated ones are, so that
+// permalinks with them keep resolving after the override changes.
+type Override struct {
+	Hidden  bool   // not shown anywhere
+	Pinned  bool   // shown at the top of the latest posts
+	Subject string // used instead of the extracted subject
+	Slug    string // used instead of the generated slug
+}
@@ -2,62 +2,72 @@ package blogplus
 
 import (
 	"bytes"
+	"html"
 	"log"
+	"net/http"
 	"net/url"
 	"path"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
+const excerptLength = 200 // in runes
+
 var (
-	anchorTagRe = regexp.MustCompile("<a .*?</a>")
-	htmlTagRe   = regexp.MustCompile("<.*?>")
+	htmlTagRe = regexp.MustCompile("<.*?>")
+	hashtagRe = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&/])#([\p{L}\p{N}_]+)`)
+	spacesRe  = regexp.MustCompile(`\s+`)
 )
 
-func isMeaningfulContent(content string) bool {
-	return len(content) > 200
+func hasAnyTag(tags []string, list []string) bool {
+	for _, tag := range tags {
+		for _, t := range list {
+			if tag == NormalizeTag(t) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
+// IsMeaningfulPost filters posts by DefaultFilterRules:
+// no reshares, and at least 200 characters of text.
 func IsMeaningfulPost(post Activity) bool {
-	// nothing for reshares
-	if post.Verb == "share" {
-		return false
-	}
-	return isMeaningfulContent(htmlTagRe.ReplaceAllString(post.Object.Content, ""))
+	return DefaultFilterRules.Match(post)
 }
 
-type TextAttachmentContext struct {
-	VisualAttachments []Attachment
-	TextAttachments   []Attachment
+// NormalizeTag returns the canonical form of hashtag, used as key in storage.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
 }
 
-func extractSubject(post *Activity) {
-	lines := strings.Split(post.Object.Content, "<br />")
-	for _, line := range lines {
-		line = anchorTagRe.ReplaceAllString(line, "")
-		if len(line) == 0 {
+func extractTags(content string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	text := htmlTagRe.ReplaceAllString(content, " ")
+	for _, m := range hashtagRe.FindAllStringSubmatch(text, -1) {
+		tag := NormalizeTag(m[1])
+		if seen[tag] {
 			continue
 		}
-		idx := strings.IndexAny(line, "\u3002.")
-		if idx > 0 {
-			if strings.HasPrefix(line[idx:], "\u3002") {
-				idx += len("\u3002")
-			} else if line[idx] == '.' {
-				idx += len(".")
-			} else {
-				panic("unexpected character at " + line[idx:])
-			}
-			post.Object.Subject = line[:idx]
-		} else {
-			post.Object.Subject = line
-		}
-		return
+		seen[tag] = true
+		tags = append(tags, tag)
 	}
-	// if it fails to extract the subject, use "title" instead
-	post.Object.Subject = post.Title
+	return tags
+}
+
+// ExtractTags fills post.Object.Tags with hashtags found in the content.
+func ExtractTags(post *Activity) {
+	post.Object.Tags = extractTags(post.Object.Content)
+}
+
+type TextAttachmentContext struct {
+	VisualAttachments []Attachment
+	TextAttachments   []Attachment
 }
 
-func formAttachments(post *Activity) {
+func formAttachments(post *Activity, templ *AttachmentTemplates) {
 	attachments := post.Object.Attachments
 	if len(attachments) == 0 {
 		post.FormedAttachment = ""
@@ -67,9 +77,9 @@ func formAttachments(post *Activity) {
 		var err error
 		switch attachment.ObjectType {
 		case "video", "photo":
-			err = ImageAttachmentTempl.Execute(buf, attachment)
+			err = templ.Image.Execute(buf, attachment)
 		case "article":
-			err = TextAttachmentTempl.Execute(buf,
+			err = templ.Text.Execute(buf,
 				TextAttachmentContext{
 					TextAttachments: []Attachment{attachment}})
 		default:
@@ -89,7 +99,7 @@ func formAttachments(post *Activity) {
 			}
 		}
 		buf := bytes.NewBuffer([]byte{})
-		err := TextAttachmentTempl.Execute(buf, tc)
+		err := templ.Text.Execute(buf, tc)
 		if err != nil {
 			log.Println("template error:", err)
 		}
@@ -97,10 +107,64 @@ func formAttachments(post *Activity) {
 	}
 }
 
-func processPost(post *Activity, postUrl *url.URL) {
-	u := *postUrl
-	u.Path = path.Join(u.Path, post.Id)
+func processPost(post *Activity, serverRoot *url.URL) {
+	u := *serverRoot
+	if slug := post.CurrentSlug(); slug != "" {
+		u.Path = path.Join(serverRoot.Path, slugPath(GetDatespec(post.Published), slug))
+	} else {
+		u.Path = path.Join(serverRoot.Path, postPath, post.Id)
+	}
 	post.Permalink = u.String()
-	formAttachments(post)
+	if post.Actor.Id != "" {
+		u.Path = path.Join(serverRoot.Path, authorPath, post.Actor.Id)
+		post.AuthorPermalink = u.String()
+	}
+	post.TagLinks = nil
+	for _, tag := range post.Object.Tags {
+		u.Path = path.Join(serverRoot.Path, tagPath, tag)
+		post.TagLinks = append(post.TagLinks, TagLink{Tag: tag, Url: u.String()})
+	}
+	if post.Override.Subject != "" {
+		post.Object.Subject = post.Override.Subject
+	}
+}
+
+// extractExcerpt sets the plain text excerpt of the content.
+func extractExcerpt(post *Activity) {
+	text := html.UnescapeString(htmlTagRe.ReplaceAllString(post.Object.SanitizedContent, " "))
+	text = strings.TrimSpace(spacesRe.ReplaceAllString(text, " "))
+	if utf8.RuneCountInString(text) > excerptLength {
+		text = string([]rune(text)[:excerptLength]) + "\u2026"
+	}
+	post.Object.Excerpt = text
+}
+
+// PreparePost sanitizes the content with ContentPolicy, keeping the
+// original, and computes the fields derived from it, i.e. tags, subject,
+// excerpts and attachments formed by templ, or by DefaultAttachmentTemplates
+// if nil.
+// Storage calls it when posts are stored, so that it is not needed
+// on every request. Permalinks are computed per request by processPost,
+// since they depend on the host and prefix.
+func PreparePost(post *Activity, templ *AttachmentTemplates) {
+	if templ == nil {
+		templ = DefaultAttachmentTemplates
+	}
+	sanitizePost(post)
+	ExtractTags(post)
 	extractSubject(post)
+	extractExcerpt(post)
+	extractContentExcerpt(post)
+	formAttachments(post, templ)
+}
+
+// Reprocess prepares all stored posts again, e.g. after attachment templates
+// are changed. The filter of s should be unset, not to drop stored posts.
+func Reprocess(s Storage, req *http.Request) int {
+	posts := GetStoredPosts(s, req)
+	for i := range posts {
+		posts[i].Override = Override{}
+	}
+	s.StorePosts(req, posts)
+	return len(posts)
 }
@@ -0,0 +1,136 @@
+package blogplus
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// formats of WriteRedirectMap.
+const (
+	RedirectMapNginx  = "nginx"
+	RedirectMapApache = "apache"
+	RedirectMapCSV    = "csv"
+)
+
+// legacyPath normalizes the path of an original post url,
+// e.g. "/u/0/+User/posts/AbC/" to "/+User/posts/AbC".
+func legacyPath(p string) string {
+	p = path.Clean("/" + p)
+	for strings.HasPrefix(p, "/u/") {
+		// account selector, e.g. /u/0/
+		s := strings.SplitN(p, "/", 4)
+		if len(s) < 4 {
+			break
+		}
+		p = "/" + s[3]
+	}
+	return p
+}
+
+// LegacyKeys returns the keys to find post from its old urls:
+// the activity id, the path of the original url and its last element.
+func LegacyKeys(post Activity) []string {
+	keys := []string{post.Id}
+	if u, err := url.Parse(post.Url); err == nil && u.Path != "" {
+		p := legacyPath(u.Path)
+		keys = append(keys, p)
+		if base := path.Base(p); base != post.Id && base != "/" {
+			keys = append(keys, base)
+		}
+	}
+	return keys
+}
+
+// lookupLegacy finds the post for u, that may be an original url,
+// its path, or a legacy id.
+func lookupLegacy(s Storage, req *http.Request, u string) (Activity, bool) {
+	if pu, err := url.Parse(u); err == nil && pu.Path != "" {
+		p := legacyPath(pu.Path)
+		if post, found := s.GetPostByLegacyKey(req, p); found {
+			return post, true
+		}
+		u = path.Base(p)
+	}
+	return s.GetPostByLegacyKey(req, u)
+}
+
+// ServeGo serves /go?u=url, redirecting an original post url to the post.
+func (b *Blogplus) ServeGo(w http.ResponseWriter, req *http.Request) {
+	u := req.FormValue("u")
+	if u == "" {
+		http.NotFound(w, req)
+		return
+	}
+	post, found := lookupLegacy(b.storage, req, u)
+	if !found || post.Override.Hidden {
+		http.NotFound(w, req)
+		return
+	}
+	processPost(&post, getServerRoot(b, req))
+	http.Redirect(w, req, post.Permalink, http.StatusMovedPermanently)
+}
+
+// nginxQuote quotes s as a string of nginx configuration.
+// Unlike Go, nginx only unescapes \", \' and \\ in quoted strings.
+func nginxQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// WriteRedirectMap writes a map from original url paths to permalinks
+// of all posts, in format:
+//
+//	nginx:  for "map $uri $blogplus_redirect { include file; }"
+//	apache: for "RewriteMap blogplus txt:file"
+//	csv:    original url, permalink
+//
+// The paths are written with and without a trailing slash, as /go
+// accepts. For nginx, paths with account selectors, such as /u/0/...,
+// are matched by a regexp per post, which nginx checks only if no exact
+// path matches.
+//
+// b.Scheme and b.Host must be set.
+func (b *Blogplus) WriteRedirectMap(w io.Writer, format string) error {
+	var req *http.Request
+	serverRoot := getServerRoot(b, req)
+	var cw *csv.Writer
+	switch format {
+	case RedirectMapNginx, RedirectMapApache:
+	case RedirectMapCSV:
+		cw = csv.NewWriter(w)
+	default:
+		return fmt.Errorf("unknown redirect map format: %s", format)
+	}
+	for _, post := range GetAllPosts(b.storage, req) {
+		u, err := url.Parse(post.Url)
+		if err != nil || u.Path == "" {
+			continue
+		}
+		processPost(&post, serverRoot)
+		p := legacyPath(u.Path)
+		switch format {
+		case RedirectMapNginx:
+			_, err = fmt.Fprintf(w, "%s %s;\n%s %s;\n%s %s;\n",
+				nginxQuote(p), nginxQuote(post.Permalink),
+				nginxQuote(p+"/"), nginxQuote(post.Permalink),
+				nginxQuote("~^(/u/[0-9]+)+"+regexp.QuoteMeta(p)+"/?$"), nginxQuote(post.Permalink))
+		case RedirectMapApache:
+			_, err = fmt.Fprintf(w, "%s %s\n%s/ %s\n", p, post.Permalink, p, post.Permalink)
+		case RedirectMapCSV:
+			err = cw.Write([]string{post.Url, post.Permalink})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if cw != nil {
+		cw.Flush()
+		return cw.Error()
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package blogplus
+
+import (
+	"encoding/xml"
+)
+
+// http://www.rssboard.org/rss-specification
+type RSSFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	AtomNS  string   `xml:"xmlns:atom,attr"`
+	Channel RSSChannel
+}
+
+type RSSChannel struct {
+	XMLName       xml.Name `xml:"channel"`
+	Title         string   `xml:"title"`
+	Link          string   `xml:"link"`
+	Description   string   `xml:"description"`
+	LastBuildDate string   `xml:"lastBuildDate,omitempty"`
+	AtomLinks     []RSSAtomLink
+	Items         []RSSItem
+}
+
+// atom:link rel="self", recommended by the feed validator,
+// and rel="hub" for WebSub.
+type RSSAtomLink struct {
+	XMLName xml.Name `xml:"atom:link"`
+	Href    string   `xml:"href,attr"`
+	Rel     string   `xml:"rel,attr"`
+	Type    string   `xml:"type,attr,omitempty"`
+}
+
+type RSSItem struct {
+	XMLName     xml.Name `xml:"item"`
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Guid        RSSGuid
+	Description string   `xml:"description"`
+	PubDate     string   `xml:"pubDate"`
+	Categories  []string `xml:"category"`
+	Enclosure   *RSSEnclosure
+}
+
+type RSSGuid struct {
+	XMLName     xml.Name `xml:"guid"`
+	Guid        string   `xml:",chardata"`
+	IsPermaLink bool     `xml:"isPermaLink,attr"`
+}
+
+type RSSEnclosure struct {
+	XMLName xml.Name `xml:"enclosure"`
+	Url     string   `xml:"url,attr"`
+	Length  int      `xml:"length,attr"`
+	Type    string   `xml:"type,attr"`
+}
@@ -0,0 +1,264 @@
+package blogplus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// SanitizePolicy describes the HTML allowed in upstream content.
+// Other elements are dropped but their text is kept, except for
+// DropElements whose content is dropped too. Comments are dropped,
+// except for <!--more-->.
+type SanitizePolicy struct {
+	// allowed elements and their allowed attributes.
+	Elements map[string][]string `json:"elements"`
+	// attributes allowed on any allowed element.
+	GlobalAttributes []string `json:"global_attributes"`
+	// elements dropped with their content.
+	DropElements []string `json:"drop_elements"`
+	// allowed schemes of urls in href, src and cite. relative urls are allowed.
+	URLSchemes []string `json:"url_schemes"`
+	// if true, rel="nofollow" is added to links to other hosts.
+	NoFollow bool `json:"nofollow"`
+	// hosts not regarded as other hosts for NoFollow.
+	InternalHosts []string `json:"internal_hosts"`
+}
+
+var DefaultSanitizePolicy = SanitizePolicy{
+	Elements: map[string][]string{
+		"a":          {"href", "rel"},
+		"abbr":       nil,
+		"b":          nil,
+		"blockquote": {"cite"},
+		"br":         nil,
+		"code":       nil,
+		"dd":         nil,
+		"del":        nil,
+		"div":        nil,
+		"dl":         nil,
+		"dt":         nil,
+		"em":         nil,
+		"figcaption": nil,
+		"figure":     nil,
+		"h1":         nil,
+		"h2":         nil,
+		"h3":         nil,
+		"h4":         nil,
+		"h5":         nil,
+		"h6":         nil,
+		"hr":         nil,
+		"i":          nil,
+		"img":        {"src", "alt", "width", "height"},
+		"ins":        nil,
+		"li":         nil,
+		"ol":         nil,
+		"p":          nil,
+		"pre":        nil,
+		"q":          {"cite"},
+		"s":          nil,
+		"small":      nil,
+		"span":       nil,
+		"strike":     nil,
+		"strong":     nil,
+		"sub":        nil,
+		"sup":        nil,
+		"table":      nil,
+		"tbody":      nil,
+		"td":         {"colspan", "rowspan"},
+		"th":         {"colspan", "rowspan"},
+		"thead":      nil,
+		"tr":         nil,
+		"u":          nil,
+		"ul":         nil,
+	},
+	GlobalAttributes: []string{"title", "lang", "dir"},
+	DropElements: []string{"script", "style", "iframe", "object", "embed",
+		"noscript", "noembed", "noframes", "frameset", "frame", "template",
+		"textarea", "select", "title", "svg", "math", "xmp", "plaintext"},
+	URLSchemes: []string{"http", "https", "mailto"},
+	NoFollow:   true,
+}
+
+// ContentPolicy is the policy PreparePost applies to the content and
+// attachment names of posts. Stored posts are sanitized again by Reprocess.
+var ContentPolicy = &DefaultSanitizePolicy
+
+// LoadSanitizePolicy reads SanitizePolicy in JSON from filename.
+func LoadSanitizePolicy(filename string) (*SanitizePolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var p SanitizePolicy
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return &p, nil
+}
+
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+var urlAttributes = map[string]bool{"href": true, "src": true, "cite": true}
+
+// link types kept in rel. others such as "me" and "webmention" would be
+// taken as the blog's own in discovery.
+var allowedRels = []string{"tag", "nofollow", "noopener", "noreferrer", "external", "ugc"}
+
+// Sanitize returns s with the HTML not allowed by p removed.
+// The result is well-formed: unclosed elements are closed,
+// and stray end tags are dropped.
+func (p *SanitizePolicy) Sanitize(s string) string {
+	var b strings.Builder
+	var open []string
+	// name and depth of the drop element being skipped.
+	skip, depth := "", 0
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		tok := z.Token()
+		if skip != "" {
+			switch {
+			case tt == html.StartTagToken && tok.Data == skip:
+				depth++
+			case tt == html.EndTagToken && tok.Data == skip:
+				depth--
+				if depth == 0 {
+					skip = ""
+				}
+			}
+			continue
+		}
+		switch tt {
+		case html.TextToken:
+			b.WriteString(html.EscapeString(tok.Data))
+		case html.CommentToken:
+			if strings.TrimSpace(tok.Data) == "more" {
+				b.WriteString("<!--more-->")
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if contains(p.DropElements, tok.Data) {
+				if tt == html.StartTagToken && !voidElements[tok.Data] {
+					skip, depth = tok.Data, 1
+				}
+				continue
+			}
+			allowed, ok := p.Elements[tok.Data]
+			if !ok {
+				continue
+			}
+			b.WriteString("<" + tok.Data)
+			for _, attr := range p.attributes(tok, allowed) {
+				b.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+			}
+			if voidElements[tok.Data] {
+				b.WriteString(" />")
+				continue
+			}
+			b.WriteString(">")
+			if tt == html.SelfClosingTagToken {
+				b.WriteString("</" + tok.Data + ">")
+				continue
+			}
+			open = append(open, tok.Data)
+		case html.EndTagToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != tok.Data {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					b.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+	return b.String()
+}
+
+// attributes returns the allowed attributes of tok.
+func (p *SanitizePolicy) attributes(tok html.Token, allowed []string) []html.Attribute {
+	var attrs []html.Attribute
+	var rel []string
+	external := false
+	seen := make(map[string]bool)
+	for _, attr := range tok.Attr {
+		key := strings.ToLower(attr.Key)
+		if attr.Namespace != "" || seen[key] {
+			continue
+		}
+		if !contains(allowed, key) && !contains(p.GlobalAttributes, key) {
+			continue
+		}
+		seen[key] = true
+		if urlAttributes[key] {
+			u, ok := p.allowedURL(attr.Val)
+			if !ok {
+				continue
+			}
+			if key == "href" && u.Host != "" && !contains(p.InternalHosts, u.Host) {
+				external = true
+			}
+		}
+		if key == "rel" {
+			for _, r := range strings.Fields(strings.ToLower(attr.Val)) {
+				if contains(allowedRels, r) && !contains(rel, r) {
+					rel = append(rel, r)
+				}
+			}
+			continue
+		}
+		attrs = append(attrs, html.Attribute{Key: key, Val: attr.Val})
+	}
+	if tok.Data == "a" && external && p.NoFollow && !contains(rel, "nofollow") {
+		rel = append(rel, "nofollow")
+	}
+	if len(rel) > 0 {
+		attrs = append(attrs, html.Attribute{Key: "rel", Val: strings.Join(rel, " ")})
+	}
+	return attrs
+}
+
+// allowedURL parses s and reports whether its scheme is allowed.
+func (p *SanitizePolicy) allowedURL(s string) (*url.URL, bool) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return nil, false
+	}
+	if u.Scheme != "" && !contains(p.URLSchemes, strings.ToLower(u.Scheme)) {
+		return nil, false
+	}
+	return u, true
+}
+
+// sanitizePost sets the content and attachment names of post sanitized
+// with ContentPolicy. The originals are kept, so that Reprocess can apply
+// a changed policy to them.
+func sanitizePost(post *Activity) {
+	post.Object.SanitizedContent = ContentPolicy.Sanitize(post.Object.Content)
+	// copy not to modify attachments of the caller.
+	attachments := make([]Attachment, len(post.Object.Attachments))
+	for i, attachment := range post.Object.Attachments {
+		attachment.SanitizedDisplayName = ContentPolicy.Sanitize(attachment.DisplayName)
+		attachments[i] = attachment
+	}
+	if post.Object.Attachments != nil {
+		post.Object.Attachments = attachments
+	}
+}
@@ -0,0 +1,111 @@
+package blogplus
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitize(t *testing.T) {
+	p := DefaultSanitizePolicy
+	p.InternalHosts = []string{"example.com"}
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"plain", `Hello <b>world</b> &amp; <i>you</i>`, `Hello <b>world</b> &amp; <i>you</i>`},
+		{"more", `a<!--more-->b<!-- secret -->`, `a<!--more-->b`},
+
+		// scripts and event handlers.
+		{"script", `a<script>alert(1)</script>b`, `ab`},
+		{"script upper", `a<SCRIPT SRC="http://evil.example/x.js"></SCRIPT>b`, `ab`},
+		{"script in script", `<script><script>alert(1)</script>alert(2)</script>`, `alert(2)`},
+		{"split script", `<scr<script>x</script>ipt>alert(1)</script>`, `xipt&gt;alert(1)`},
+		{"onerror", `<img src="x.png" onerror="alert(1)">`, `<img src="x.png" />`},
+		{"onclick", `<a href="/p" onclick="alert(1)" OnMouseOver=alert(2)>x</a>`, `<a href="/p">x</a>`},
+		{"onload", `<b onload=alert(1)>x</b>`, `<b>x</b>`},
+		{"style attr", `<p style="background:url(javascript:alert(1))">x</p>`, `<p>x</p>`},
+		{"style", `<style>body{}</style>x`, `x`},
+		{"iframe", `<iframe src="http://evil.example/"></iframe>x`, `x`},
+		{"object", `<object data="x.swf"><embed src="x.swf"></object>x`, `x`},
+		{"form", `<form action="http://evil.example/"><input name="p"></form>x`, `x`},
+
+		// urls.
+		{"javascript", `<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript mixed case", `<a href="JaVaScRiPt:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript spaces", `<a href="  javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript entity", `<a href="&#106;avascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript hex entity", `<a href="&#x6A;&#x61;vascript&#x3A;alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript named entity", `<a href="javascript&colon;alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript tab", "<a href=\"java\tscript:alert(1)\">x</a>", `<a>x</a>`},
+		{"javascript tab entity", `<a href="java&#x09;script:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript newline entity", `<a href="java&#10;script:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript nul", "<a href=\"java\x00script:alert(1)\">x</a>", `<a>x</a>`},
+		{"javascript control", "<a href=\"\x01javascript:alert(1)\">x</a>", `<a>x</a>`},
+		{"vbscript", `<a href="vbscript:msgbox(1)">x</a>`, `<a>x</a>`},
+		{"data img", `<img src="data:image/svg+xml;base64,PHN2Zz4=">`, `<img />`},
+		{"data href", `<a href="data:text/html,<script>alert(1)</script>">x</a>`, `<a>x</a>`},
+		{"blockquote cite", `<blockquote cite="javascript:alert(1)">q</blockquote>`, `<blockquote>q</blockquote>`},
+		{"mailto", `<a href="mailto:a@example.com">m</a>`, `<a href="mailto:a@example.com">m</a>`},
+		{"relative", `<a href="/2012/05/post">p</a>`, `<a href="/2012/05/post">p</a>`},
+		{"quote in url", `<a href='/p?q="x"'>p</a>`, `<a href="/p?q=&#34;x&#34;">p</a>`},
+
+		// svg and math are dropped with their content.
+		{"svg", `<svg onload="alert(1)"><script>alert(2)</script><a href="javascript:alert(3)">x</a></svg>y`, `y`},
+		{"svg nested", `<svg><svg></svg>x</svg>y`, `y`},
+		{"math", `<math><mtext><table><mglyph><style><img src=x onerror=alert(1)>`, ``},
+		{"math closed", `<math><mi>x</mi></math>y`, `y`},
+		{"self closing svg", `<svg/>y`, `y`},
+
+		// unclosed and stray tags.
+		{"unclosed", `<b>bold <i>both`, `<b>bold <i>both</i></b>`},
+		{"stray end", `x</div></b>y`, `xy`},
+		{"misnested", `<b><i>x</b>y</i>`, `<b><i>x</i></b>y`},
+		{"self closing", `<b/>x`, `<b></b>x`},
+		{"unterminated tag", `x<img src="a.png" onerror="alert(1)"`, `x`},
+		{"lt", `1 < 2 > 0`, `1 &lt; 2 &gt; 0`},
+
+		// rel and nofollow.
+		{"external", `<a href="http://other.example/">x</a>`, `<a href="http://other.example/" rel="nofollow">x</a>`},
+		{"external rel", `<a href="https://other.example/" rel="me noopener">x</a>`, `<a href="https://other.example/" rel="noopener nofollow">x</a>`},
+		{"external nofollow", `<a href="https://other.example/" rel="NoFollow">x</a>`, `<a href="https://other.example/" rel="nofollow">x</a>`},
+		{"internal", `<a href="http://example.com/p">x</a>`, `<a href="http://example.com/p">x</a>`},
+		{"relative nofollow", `<a href="/p" rel="tag">x</a>`, `<a href="/p" rel="tag">x</a>`},
+		{"webmention rel", `<a href="/wm" rel="webmention">x</a>`, `<a href="/wm">x</a>`},
+		{"bad href no nofollow", `<a href="javascript:x" rel="external">x</a>`, `<a rel="external">x</a>`},
+	} {
+		if got := p.Sanitize(tc.in); got != tc.want {
+			t.Errorf("%s: Sanitize(%q)=%q; want %q", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSanitizeNoFollowDisabled(t *testing.T) {
+	p := DefaultSanitizePolicy
+	p.NoFollow = false
+	in := `<a href="http://other.example/">x</a>`
+	if got := p.Sanitize(in); got != in {
+		t.Errorf("Sanitize(%q)=%q; want unchanged", in, got)
+	}
+}
+
+func TestReprocessAppliesChangedPolicy(t *testing.T) {
+	defer func(orig *SanitizePolicy) { ContentPolicy = orig }(ContentPolicy)
+	strict := DefaultSanitizePolicy
+	strict.Elements = map[string][]string{"p": nil}
+	ContentPolicy = &strict
+
+	s := NewMemStorage()
+	post := testPost("rp1", time.Now(), "<p>Some <em>emphasized</em> text.</p>")
+	s.StorePosts(nil, []Activity{post})
+	stored, _ := s.GetPost(nil, "rp1")
+	if got := string(stored.Object.HTMLContent()); strings.Contains(got, "<em>") {
+		t.Fatalf("strict policy kept <em>: %s", got)
+	}
+
+	ContentPolicy = &DefaultSanitizePolicy
+	Reprocess(s, nil)
+	stored, _ = s.GetPost(nil, "rp1")
+	if got := string(stored.Object.HTMLContent()); !strings.Contains(got, "<em>emphasized</em>") {
+		t.Errorf("reprocessed content lacks <em> allowed by the new policy: %s", got)
+	}
+}
@@ -0,0 +1,119 @@
+package blogplus
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Sitemaps: https://www.sitemaps.org/protocol.html
+
+const (
+	sitemapPath = "/sitemap.xml"
+	robotsPath  = "/robots.txt"
+)
+
+var (
+	// /sitemap-YYYY-MM.xml
+	sitemapMonthRe = regexp.MustCompile(`^/sitemap-(\d{4}-\d{2})\.xml$`)
+)
+
+type SitemapIndex struct {
+	XMLName  xml.Name `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []SitemapEntry
+}
+
+type SitemapEntry struct {
+	XMLName xml.Name `xml:"sitemap"`
+	Loc     string   `xml:"loc"`
+	Lastmod string   `xml:"lastmod,omitempty"`
+}
+
+type SitemapURLSet struct {
+	XMLName xml.Name `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []SitemapURL
+}
+
+type SitemapURL struct {
+	XMLName xml.Name `xml:"url"`
+	Loc     string   `xml:"loc"`
+	Lastmod string   `xml:"lastmod,omitempty"`
+}
+
+// sitemapMonthPath returns the path of the sitemap of datespec "YYYY-MM".
+func sitemapMonthPath(datespec string) string {
+	return "/sitemap-" + datespec + ".xml"
+}
+
+// ServeSitemap serves /sitemap.xml, the index of the sitemaps of months,
+// and /sitemap-YYYY-MM.xml, the sitemap of posts in the month.
+func (b *Blogplus) ServeSitemap(w http.ResponseWriter, req *http.Request) {
+	serverRoot := getServerRoot(b, req)
+	p := strings.TrimPrefix(req.URL.Path, b.Prefix)
+	var v interface{}
+	var posts []Activity
+	if m := sitemapMonthRe.FindStringSubmatch(p); m != nil {
+		var urls []SitemapURL
+		for _, post := range b.storage.GetArchivedPosts(req, m[1]) {
+			processPost(&post, serverRoot)
+			posts = append(posts, post)
+			urls = append(urls, SitemapURL{Loc: post.Permalink, Lastmod: post.Updated})
+		}
+		if len(urls) == 0 {
+			http.NotFound(w, req)
+			return
+		}
+		v = SitemapURLSet{URLs: urls}
+	} else {
+		var sitemaps []SitemapEntry
+		latest := Activity{}
+		for _, item := range b.storage.GetDates(req) {
+			if latest.Updated < item.Updated {
+				latest.Updated = item.Updated
+			}
+			sitemaps = append(sitemaps, SitemapEntry{
+				Loc:     serverRoot.String() + sitemapMonthPath(item.Datespec),
+				Lastmod: item.Updated})
+		}
+		posts = append(posts, latest)
+		v = SitemapIndex{Sitemaps: sitemaps}
+	}
+	data, err := xml.Marshal(v)
+	if err != nil {
+		log.Println("sitemap error:", err)
+		http.Error(w, "sitemap error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	setLastModified(w, posts...)
+	_, err = io.WriteString(w, xml.Header)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err != nil {
+		log.Println("sitemap write error:", err)
+	}
+}
+
+// ServeRobots serves /robots.txt, b.RobotsTxt followed by the sitemap.
+// If b.RobotsTxt is empty, admin pages are disallowed. Since crawlers
+// only read /robots.txt at the root of the host, it is routed there as
+// well as under b.Prefix; if b only handles paths under b.Prefix, a proxy
+// must pass /robots.txt to it.
+func (b *Blogplus) ServeRobots(w http.ResponseWriter, req *http.Request) {
+	robots := b.RobotsTxt
+	if robots == "" {
+		robots = "User-agent: *\nDisallow: " + b.Prefix + adminPath + "\n"
+	}
+	if !strings.HasSuffix(robots, "\n") {
+		robots += "\n"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := io.WriteString(w, robots+"\nSitemap: "+getServerRoot(b, req).String()+sitemapPath+"\n")
+	if err != nil {
+		log.Println("robots write error:", err)
+	}
+}
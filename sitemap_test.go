@@ -0,0 +1,53 @@
+package blogplus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSitemapIndex(t *testing.T) {
+	b, s := newTestBlogplus()
+	jan := time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2020, 2, 10, 0, 0, 0, 0, time.UTC)
+	updated := testPost("s2", jan.Add(24*time.Hour), "Edited post")
+	updated.Updated = "2020-03-01T00:00:00Z"
+	s.StorePosts(nil, []Activity{
+		testPost("s1", jan, "First post"),
+		updated,
+		testPost("s3", feb, "Hidden post"),
+		testPost("s4", feb.Add(-time.Hour), "Last post"),
+	})
+	s.SetOverride(nil, "s3", Override{Hidden: true})
+
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/sitemap.xml", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /sitemap.xml: %d %s", w.Code, w.Body)
+	}
+	for _, want := range []string{
+		"<loc>http://example.com/sitemap-2020-01.xml</loc><lastmod>2020-03-01T00:00:00Z</lastmod>",
+		"<loc>http://example.com/sitemap-2020-02.xml</loc><lastmod>2020-02-09T23:00:00Z</lastmod>",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("sitemap index lacks %q:\n%s", want, w.Body)
+		}
+	}
+	if got, want := w.Header().Get("Last-Modified"), "Sun, 01 Mar 2020 00:00:00 GMT"; got != want {
+		t.Errorf("Last-Modified = %q; want %q", got, want)
+	}
+}
+
+func TestRobotsAtRoot(t *testing.T) {
+	b, _ := newTestBlogplus()
+	b.Prefix = "/blog"
+	for _, p := range []string{"/robots.txt", "/blog/robots.txt"} {
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com"+p, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Sitemap: http://example.com/blog/sitemap.xml\n") {
+			t.Errorf("GET %s: %d %s", p, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package blogplus
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const maxSlugLength = 60 // in runes
+
+var (
+	// /YYYY/MM/slug
+	slugPathRe = regexp.MustCompile(`^/(\d{4})/(\d{2})/([^/]+)$`)
+)
+
+// MakeSlug makes a slug from subject.
+// ASCII letters are lower-cased, other letters such as CJK are kept
+// as is (they are percent-encoded in URLs), and everything else becomes "-".
+func MakeSlug(subject string) string {
+	var b strings.Builder
+	n := 0
+	dash := false
+	for _, r := range strings.ToLower(subject) {
+		if n >= maxSlugLength {
+			break
+		}
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+				n++
+			}
+			dash = false
+			b.WriteRune(r)
+			n++
+			continue
+		}
+		if r == '\'' || r == '’' {
+			// "don't" -> "dont"
+			continue
+		}
+		dash = true
+	}
+	return b.String()
+}
+
+// slugPath returns the path of the permalink for datespec and slug.
+func slugPath(datespec, slug string) string {
+	return "/" + strings.Replace(datespec, "-", "/", 1) + "/" + slug
+}
+
+// CurrentSlug returns the slug used in the permalink of post.
+func (a Activity) CurrentSlug() string {
+	if a.Override.Slug != "" {
+		return a.Override.Slug
+	}
+	return a.Slug
+}
+
+// assignSlug sets the slug of a new post, from post.Slug if set, such as
+// mp-slug of Micropub, or from its subject. post must be prepared by
+// PreparePost. taken reports whether the slug is already used in the
+// month, in which case a number is appended to the slug.
+func assignSlug(post *Activity, taken func(datespec, slug string) bool) {
+	base := MakeSlug(post.Slug)
+	if base == "" {
+		base = MakeSlug(post.Object.Subject)
+	}
+	if base == "" {
+		base = strings.ToLower(post.Id)
+	}
+	datespec := GetDatespec(post.Published)
+	slug := base
+	for i := 2; taken(datespec, slug); i++ {
+		slug = fmt.Sprintf("%s-%d", base, i)
+	}
+	post.Slug = slug
+}
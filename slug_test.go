@@ -0,0 +1,43 @@
+package blogplus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOverrideSlug(t *testing.T) {
+	b, s := newTestBlogplus()
+	published := time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC)
+	s.StorePosts(nil, []Activity{
+		testPost("os1", published, "First post."),
+		testPost("os2", published, "Second post."),
+	})
+	for _, slug := range []string{"a/b", "a b", "a?b", "Upper"} {
+		if err := s.SetOverride(nil, "os1", Override{Slug: slug}); err != ErrBadSlug {
+			t.Errorf("SetOverride(%q) = %v; want ErrBadSlug", slug, err)
+		}
+	}
+	if err := s.SetOverride(nil, "os1", Override{Slug: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOverride(nil, "os1", Override{Slug: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOverride(nil, "os2", Override{Slug: "old"}); err != ErrSlugTaken {
+		t.Errorf("SetOverride of a used slug = %v; want ErrSlugTaken", err)
+	}
+	for _, p := range []string{"/2020/01/first-post", "/2020/01/old"} {
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com"+p, nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "http://example.com/2020/01/new" {
+			t.Errorf("GET %s: %d %s", p, w.Code, w.Header().Get("Location"))
+		}
+	}
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/2020/01/new", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /2020/01/new: %d", w.Code)
+	}
+}
@@ -2,10 +2,12 @@ package blogplus
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"sort"
+	"sync"
 )
 
 const (
@@ -13,8 +15,121 @@ const (
 create index published_idx on blogplus (published desc);
 create index datespec_idx on blogplus (datespec desc);
 `
+
+	// selects post with its override, to be scanned by scanPost.
+	selectPost = `select post, coalesce(hidden, 0), coalesce(pinned, 0), coalesce(subject, ''), coalesce(slug, '') from blogplus left join blogplus_overrides using (id) `
+	notHidden  = `coalesce(hidden, 0) = 0`
 )
 
+// dbUpgrade is a step to upgrade the schema of databases created by
+// older versions. Steps are applied in order when the database is opened,
+// from the version recorded in "pragma user_version", and must be
+// idempotent, since a step may be interrupted.
+type dbUpgrade struct {
+	columns []dbColumn // added unless they exist
+	stmts   string     // such as "create table if not exists"
+	// posts are stored again by Reprocess, to fill new columns or tables.
+	reprocess bool
+}
+
+type dbColumn struct {
+	table, name, typ string
+}
+
+var dbUpgrades = []dbUpgrade{
+	// authors of posts.
+	{columns: []dbColumn{{"blogplus", "actor", "text"}},
+		stmts:     `create index if not exists actor_idx on blogplus (actor, published desc);`,
+		reprocess: true},
+	// tag index.
+	{stmts: `create table if not exists blogplus_tags (tag text not null, id text not null, published text, primary key (tag, id));
+create index if not exists tag_idx on blogplus_tags (tag, published desc);
+create index if not exists tag_id_idx on blogplus_tags (id);`,
+		reprocess: true},
+	// moderation overrides.
+	{stmts: `create table if not exists blogplus_overrides (id text not null primary key, hidden integer, pinned integer, subject text, slug text);`},
+	// slug permalinks.
+	{stmts: `create table if not exists blogplus_slugs (datespec text not null, slug text not null, id text not null, primary key (datespec, slug));
+create index if not exists slug_id_idx on blogplus_slugs (id);`,
+		reprocess: true},
+	// original urls.
+	{stmts: `create table if not exists blogplus_legacy (key text not null primary key, id text not null);`,
+		reprocess: true},
+	// subject, excerpt and attachments prepared when stored.
+	{reprocess: true},
+	// updates of posts.
+	{columns: []dbColumn{{"blogplus", "updated", "text"}},
+		reprocess: true},
+	// received webmentions.
+	{stmts: `create table if not exists blogplus_mentions (source text not null, id text not null, target text, title text, author text, received text, approved integer, primary key (source, id));
+create index if not exists mention_id_idx on blogplus_mentions (id, received);`},
+	// activitypub followers.
+	{stmts: `create table if not exists blogplus_followers (id text not null primary key, inbox text, followed text);`},
+	// content sanitized when stored.
+	{reprocess: true},
+	// slugs of overrides recorded with generated ones.
+	{stmts: `insert or ignore into blogplus_slugs(datespec, slug, id) select datespec, slug, id from blogplus_overrides join blogplus using (id) where coalesce(slug, '') != '';`},
+	// sanitized content kept apart from the original.
+	{reprocess: true},
+}
+
+// upgradeDB applies dbUpgrades not applied to db yet. It returns
+// whether posts need to be reprocessed. The version is not updated
+// until setDBVersion.
+func upgradeDB(db *sql.DB) (reprocess bool, err error) {
+	var version int
+	err = db.QueryRow(`pragma user_version`).Scan(&version)
+	if err != nil {
+		return false, err
+	}
+	for i := version; i < len(dbUpgrades); i++ {
+		u := dbUpgrades[i]
+		for _, c := range u.columns {
+			err = addColumn(db, c)
+			if err != nil {
+				return false, err
+			}
+		}
+		if u.stmts != "" {
+			_, err = db.Exec(u.stmts)
+			if err != nil {
+				return false, err
+			}
+		}
+		reprocess = reprocess || u.reprocess
+		log.Println("db upgraded to version", i+1)
+	}
+	return reprocess, nil
+}
+
+func setDBVersion(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf(`pragma user_version = %d`, len(dbUpgrades)))
+	return err
+}
+
+// addColumn adds column c, unless the table has it.
+func addColumn(db *sql.DB, c dbColumn) error {
+	rows, err := db.Query(`pragma table_info(` + c.table + `)`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt interface{}
+		err = rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk)
+		if err != nil {
+			return err
+		}
+		if name == c.name {
+			return nil
+		}
+	}
+	_, err = db.Exec(`alter table ` + c.table + ` add column ` + c.name + ` ` + c.typ)
+	return err
+}
+
 func InitDB(driver, datasource string) (*sql.DB, error) {
 	log.Println("Initialize db:", driver, ":", datasource)
 	os.Remove(datasource)
@@ -23,6 +138,12 @@ func InitDB(driver, datasource string) (*sql.DB, error) {
 		return nil, err
 	}
 	_, err = db.Exec(createTable)
+	if err == nil {
+		_, err = upgradeDB(db)
+	}
+	if err == nil {
+		err = setDBVersion(db)
+	}
 	if err != nil {
 		db.Close()
 		return nil, err
@@ -33,55 +154,171 @@ func InitDB(driver, datasource string) (*sql.DB, error) {
 type DBStorage struct {
 	db     *sql.DB
 	filter func(Activity) bool
+	hooks  []StoreHook
+
+	templMu sync.Mutex
+	templ   *AttachmentTemplates
 }
 
+// NewDBStorage opens the database, and upgrades it if it was created
+// by an older version. Posts are reprocessed by the upgrade if needed,
+// with the default attachment templates.
 func NewDBStorage(driver, datasource string) (*DBStorage, error) {
 	db, err := sql.Open(driver, datasource)
 	if err != nil {
 		return nil, err
 	}
-
-	return &DBStorage{db: db}, nil
+	s := &DBStorage{db: db}
+	reprocess, err := upgradeDB(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db upgrade: %v", err)
+	}
+	if reprocess {
+		log.Printf("db upgrade: %d posts reprocessed", Reprocess(s, nil))
+	}
+	err = setDBVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
 }
 
 func (s *DBStorage) SetFilter(filter func(Activity) bool) {
 	s.filter = filter
 }
 
+// SetAttachmentTemplates sets the templates forming attachments of posts
+// stored hereafter; nil means DefaultAttachmentTemplates.
+func (s *DBStorage) SetAttachmentTemplates(templ *AttachmentTemplates) {
+	s.templMu.Lock()
+	defer s.templMu.Unlock()
+	s.templ = templ
+}
+
+// AddStoreHook adds hook. It must be called before any StorePosts.
+func (s *DBStorage) AddStoreHook(hook StoreHook) {
+	s.hooks = append(s.hooks, hook)
+}
+
 func (s *DBStorage) StorePosts(req *http.Request, posts []Activity) {
-	stmt, err := s.db.Prepare(`insert or replace into blogplus(id, published, datespec, post) values(?, ?, ?, ?)`)
+	stmt, err := s.db.Prepare(`insert or replace into blogplus(id, published, updated, datespec, actor, post) values(?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		panic(err)
 	}
 	defer stmt.Close()
+	deleteTags, err := s.db.Prepare(`delete from blogplus_tags where id = ?`)
+	if err != nil {
+		panic(err)
+	}
+	defer deleteTags.Close()
+	insertTag, err := s.db.Prepare(`insert or replace into blogplus_tags(tag, id, published) values(?, ?, ?)`)
+	if err != nil {
+		panic(err)
+	}
+	defer insertTag.Close()
+	s.templMu.Lock()
+	templ := s.templ
+	s.templMu.Unlock()
+	var changed []Activity
 	for _, post := range posts {
 		if s.filter != nil && !s.filter(post) {
 			continue
 		}
+		PreparePost(&post, templ)
 		datespec := GetDatespec(post.Published)
+		var updated string
+		err = s.db.QueryRow(`select updated from blogplus where id = ?`, post.Id).Scan(&updated)
+		isChanged := err == sql.ErrNoRows || (err == nil && updated != post.Updated)
+		err = s.db.QueryRow(`select slug from blogplus_slugs where id = ? order by rowid limit 1`, post.Id).Scan(&post.Slug)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Println("StorePosts slug:", err)
+			}
+			s.assignSlug(&post)
+		}
+		if isChanged {
+			changed = append(changed, post)
+		}
+		for _, key := range LegacyKeys(post) {
+			_, err = s.db.Exec(`insert or replace into blogplus_legacy(key, id) values(?, ?)`, key, post.Id)
+			if err != nil {
+				log.Println("StorePosts legacy:", err)
+			}
+		}
 		data, err := EncodeActivity(post)
 		if err != nil {
 			log.Println("encode error:", err)
 			continue
 		}
-		_, err = stmt.Exec(post.Id, post.Published, datespec, data)
+		_, err = stmt.Exec(post.Id, post.Published, post.Updated, datespec, post.Actor.Id, data)
 		if err != nil {
 			log.Println("StorePosts:", err)
+			continue
 		}
+		_, err = deleteTags.Exec(post.Id)
+		if err != nil {
+			log.Println("StorePosts tags:", err)
+		}
+		for _, tag := range post.Object.Tags {
+			_, err = insertTag.Exec(tag, post.Id, post.Published)
+			if err != nil {
+				log.Println("StorePosts tags:", err)
+			}
+		}
+	}
+	runStoreHooks(s.hooks, req, changed, StoreChanged)
+}
+
+// assignSlug assigns and records the slug of a new post. If another
+// process takes the slug first, the next one is tried.
+func (s *DBStorage) assignSlug(post *Activity) {
+	preferred := post.Slug
+	for {
+		post.Slug = preferred
+		assignSlug(post, s.slugTaken)
+		res, err := s.db.Exec(`insert or ignore into blogplus_slugs(datespec, slug, id) values(?, ?, ?)`, GetDatespec(post.Published), post.Slug, post.Id)
+		if err != nil {
+			log.Println("StorePosts slug:", err)
+			return
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return
+		}
+	}
+}
+
+func (s *DBStorage) slugTaken(datespec, slug string) bool {
+	return s.slugUsed(datespec, slug, "")
+}
+
+// slugUsed reports whether slug is used in the month by a post other
+// than except, as a generated slug or an override.
+func (s *DBStorage) slugUsed(datespec, slug, except string) bool {
+	var n int
+	err := s.db.QueryRow(`select count(*) from blogplus_slugs where datespec = ? and slug = ? and id != ?`,
+		datespec, slug, except).Scan(&n)
+	if err != nil {
+		log.Println("slugUsed:", err)
 	}
+	return n > 0
 }
 
 func scanPost(rows *sql.Rows) (post Activity, err error) {
 	var data []byte
-	err = rows.Scan(&data)
+	var o Override
+	err = rows.Scan(&data, &o.Hidden, &o.Pinned, &o.Subject, &o.Slug)
 	if err != nil {
 		return post, err
 	}
-	return DecodeActivity(data)
+	post, err = DecodeActivity(data)
+	post.Override = o
+	return post, err
 }
 
 func (s *DBStorage) GetLatestPosts(req *http.Request) []Activity {
-	rows, err := s.db.Query(`select post from blogplus order by published desc limit 10`)
+	rows, err := s.db.Query(selectPost + `where ` + notHidden + ` order by coalesce(pinned, 0) desc, published desc limit 10`)
 	if err != nil {
 		panic(err)
 	}
@@ -96,8 +333,29 @@ func (s *DBStorage) GetLatestPosts(req *http.Request) []Activity {
 	return posts
 }
 
+func (s *DBStorage) GetPagedPosts(req *http.Request, offset, limit int) []Activity {
+	stmt, err := s.db.Prepare(selectPost + `where ` + notHidden + ` order by published desc limit ? offset ?`)
+	if err != nil {
+		panic(err)
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(limit, offset)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var posts []Activity
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err == nil {
+			posts = append(posts, post)
+		}
+	}
+	return posts
+}
+
 func (s *DBStorage) GetPost(req *http.Request, activityId string) (Activity, bool) {
-	stmt, err := s.db.Prepare(`select post from blogplus where id = ?`)
+	stmt, err := s.db.Prepare(selectPost + `where id = ?`)
 	if err != nil {
 		panic(err)
 	}
@@ -118,8 +376,33 @@ func (s *DBStorage) GetPost(req *http.Request, activityId string) (Activity, boo
 	return post, err == nil
 }
 
+func (s *DBStorage) GetPostBySlug(req *http.Request, datespec, slug string) (Activity, bool) {
+	var activityId string
+	err := s.db.QueryRow(`select id from blogplus_slugs where datespec = ? and slug = ?`,
+		datespec, slug).Scan(&activityId)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("GetPostBySlug:", err)
+		}
+		return Activity{}, false
+	}
+	return s.GetPost(req, activityId)
+}
+
+func (s *DBStorage) GetPostByLegacyKey(req *http.Request, key string) (Activity, bool) {
+	var activityId string
+	err := s.db.QueryRow(`select id from blogplus_legacy where key = ?`, key).Scan(&activityId)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("GetPostByLegacyKey:", err)
+		}
+		return Activity{}, false
+	}
+	return s.GetPost(req, activityId)
+}
+
 func (s *DBStorage) GetDates(req *http.Request) []ArchiveItem {
-	rows, err := s.db.Query(`select datespec, count(*) from blogplus group by datespec`)
+	rows, err := s.db.Query(`select datespec, count(*), coalesce(max(updated), '') from blogplus left join blogplus_overrides using (id) where ` + notHidden + ` group by datespec`)
 	if err != nil {
 		panic(err)
 	}
@@ -127,7 +410,7 @@ func (s *DBStorage) GetDates(req *http.Request) []ArchiveItem {
 	var archiveItems ArchiveItemList
 	for rows.Next() {
 		var ai ArchiveItem
-		err = rows.Scan(&ai.Datespec, &ai.Count)
+		err = rows.Scan(&ai.Datespec, &ai.Count, &ai.Updated)
 		if err != nil {
 			continue
 		}
@@ -138,12 +421,13 @@ func (s *DBStorage) GetDates(req *http.Request) []ArchiveItem {
 }
 
 func (s *DBStorage) GetArchivedPosts(req *http.Request, datespec string) []Activity {
-	stmt, err := s.db.Prepare(`select post from blogplus where datespec = ? order by published desc`)
+	stmt, err := s.db.Prepare(selectPost + `where (datespec = ? or datespec like ?) and ` + notHidden + ` order by published desc`)
 	if err != nil {
 		panic(err)
 	}
 	defer stmt.Close()
-	rows, err := stmt.Query(datespec)
+	// datespec may be a year.
+	rows, err := stmt.Query(datespec, datespec+"-%")
 	if err != nil {
 		return nil
 	}
@@ -157,3 +441,199 @@ func (s *DBStorage) GetArchivedPosts(req *http.Request, datespec string) []Activ
 	}
 	return posts
 }
+
+func (s *DBStorage) GetAuthorPosts(req *http.Request, actorId string) []Activity {
+	stmt, err := s.db.Prepare(selectPost + `where actor = ? and ` + notHidden + ` order by published desc limit 10`)
+	if err != nil {
+		panic(err)
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(actorId)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var posts []Activity
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err == nil {
+			posts = append(posts, post)
+		}
+	}
+	return posts
+}
+
+func (s *DBStorage) GetTags(req *http.Request) []TagItem {
+	rows, err := s.db.Query(`select tag, count(*) from blogplus_tags left join blogplus_overrides using (id) where ` + notHidden + ` group by tag`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	var tagItems TagItemList
+	for rows.Next() {
+		var ti TagItem
+		err = rows.Scan(&ti.Tag, &ti.Count)
+		if err != nil {
+			continue
+		}
+		tagItems = append(tagItems, ti)
+	}
+	sort.Sort(tagItems)
+	return tagItems
+}
+
+func (s *DBStorage) GetTaggedPosts(req *http.Request, tag string) []Activity {
+	stmt, err := s.db.Prepare(`select post, coalesce(hidden, 0), coalesce(pinned, 0), coalesce(subject, ''), coalesce(slug, '') from blogplus join blogplus_tags using (id) left join blogplus_overrides using (id) where tag = ? and ` + notHidden + ` order by blogplus.published desc`)
+	if err != nil {
+		panic(err)
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(NormalizeTag(tag))
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var posts []Activity
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err == nil {
+			posts = append(posts, post)
+		}
+	}
+	return posts
+}
+
+func (s *DBStorage) SetOverride(req *http.Request, activityId string, o Override) error {
+	if o.Slug != MakeSlug(o.Slug) {
+		return ErrBadSlug
+	}
+	if post, found := s.GetPost(req, activityId); found && post.Override == o {
+		return nil
+	}
+	if o.Slug != "" {
+		var datespec, owner string
+		err := s.db.QueryRow(`select datespec from blogplus where id = ?`, activityId).Scan(&datespec)
+		if err == nil {
+			_, err = s.db.Exec(`insert or ignore into blogplus_slugs(datespec, slug, id) values(?, ?, ?)`, datespec, o.Slug, activityId)
+		}
+		if err == nil {
+			err = s.db.QueryRow(`select id from blogplus_slugs where datespec = ? and slug = ?`, datespec, o.Slug).Scan(&owner)
+		}
+		if err != nil && err != sql.ErrNoRows {
+			log.Println("SetOverride slug:", err)
+			return err
+		}
+		if err == nil && owner != activityId {
+			return ErrSlugTaken
+		}
+	}
+	var err error
+	if o == (Override{}) {
+		_, err = s.db.Exec(`delete from blogplus_overrides where id = ?`, activityId)
+	} else {
+		_, err = s.db.Exec(`insert or replace into blogplus_overrides(id, hidden, pinned, subject, slug) values(?, ?, ?, ?, ?)`,
+			activityId, o.Hidden, o.Pinned, o.Subject, o.Slug)
+	}
+	if err != nil {
+		log.Println("SetOverride:", err)
+		return err
+	}
+	if post, found := s.GetPost(req, activityId); found {
+		runStoreHooks(s.hooks, req, []Activity{post}, StoreOverridden)
+	}
+	return nil
+}
+
+func (s *DBStorage) GetOverrides(req *http.Request) map[string]Override {
+	rows, err := s.db.Query(`select id, hidden, pinned, subject, slug from blogplus_overrides`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	overrides := make(map[string]Override)
+	for rows.Next() {
+		var id string
+		var o Override
+		err = rows.Scan(&id, &o.Hidden, &o.Pinned, &o.Subject, &o.Slug)
+		if err != nil {
+			continue
+		}
+		overrides[id] = o
+	}
+	return overrides
+}
+
+func (s *DBStorage) StoreMention(req *http.Request, m Mention) {
+	_, err := s.db.Exec(`insert or replace into blogplus_mentions(source, id, target, title, author, received, approved) values(?, ?, ?, ?, ?, ?, ?)`,
+		m.Source, m.PostId, m.Target, m.Title, m.Author, m.Received, m.Approved)
+	if err != nil {
+		log.Println("StoreMention:", err)
+	}
+}
+
+func (s *DBStorage) DeleteMention(req *http.Request, source, activityId string) {
+	_, err := s.db.Exec(`delete from blogplus_mentions where source = ? and id = ?`, source, activityId)
+	if err != nil {
+		log.Println("DeleteMention:", err)
+	}
+}
+
+const selectMention = `select source, id, target, title, author, received, approved from blogplus_mentions `
+
+func (s *DBStorage) queryMentions(query string, args ...interface{}) []Mention {
+	rows, err := s.db.Query(selectMention+query, args...)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	var mentions []Mention
+	for rows.Next() {
+		var m Mention
+		err = rows.Scan(&m.Source, &m.PostId, &m.Target, &m.Title, &m.Author, &m.Received, &m.Approved)
+		if err != nil {
+			continue
+		}
+		mentions = append(mentions, m)
+	}
+	return mentions
+}
+
+func (s *DBStorage) GetMentions(req *http.Request, activityId string) []Mention {
+	return s.queryMentions(`where id = ? order by received`, activityId)
+}
+
+func (s *DBStorage) GetPendingMentions(req *http.Request) []Mention {
+	return s.queryMentions(`where approved = 0 order by received`)
+}
+
+func (s *DBStorage) AddFollower(req *http.Request, f Follower) {
+	_, err := s.db.Exec(`insert or replace into blogplus_followers(id, inbox, followed) values(?, ?, ?)`, f.Id, f.Inbox, f.Followed)
+	if err != nil {
+		log.Println("AddFollower:", err)
+	}
+}
+
+func (s *DBStorage) RemoveFollower(req *http.Request, actorId string) {
+	_, err := s.db.Exec(`delete from blogplus_followers where id = ?`, actorId)
+	if err != nil {
+		log.Println("RemoveFollower:", err)
+	}
+}
+
+func (s *DBStorage) GetFollowers(req *http.Request) []Follower {
+	rows, err := s.db.Query(`select id, inbox, followed from blogplus_followers order by followed`)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	var followers []Follower
+	for rows.Next() {
+		var f Follower
+		err = rows.Scan(&f.Id, &f.Inbox, &f.Followed)
+		if err != nil {
+			continue
+		}
+		followers = append(followers, f)
+	}
+	return followers
+}
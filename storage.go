@@ -1,7 +1,6 @@
 package blogplus
 
 import (
-	"container/heap"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,18 +9,49 @@ import (
 	"sync"
 )
 
+// StoreReason tells StoreHook why posts are changed.
+type StoreReason int
+
+const (
+	// posts are newly stored, or their content is updated.
+	StoreChanged StoreReason = iota
+	// only the override of the post is set, e.g. hidden or pinned.
+	StoreOverridden
+)
+
+// StoreHook is called with posts that are newly stored or updated.
+type StoreHook func(req *http.Request, posts []Activity, reason StoreReason)
+
 type Storage interface {
 	SetFilter(func(Activity) bool)
+	SetAttachmentTemplates(templ *AttachmentTemplates)
+	AddStoreHook(hook StoreHook)
 	StorePosts(req *http.Request, posts []Activity)
 	GetLatestPosts(req *http.Request) []Activity
+	GetPagedPosts(req *http.Request, offset, limit int) []Activity
 	GetPost(req *http.Request, activityId string) (Activity, bool)
+	GetPostBySlug(req *http.Request, datespec, slug string) (Activity, bool)
+	GetPostByLegacyKey(req *http.Request, key string) (Activity, bool)
 	GetDates(req *http.Request) []ArchiveItem
 	GetArchivedPosts(req *http.Request, datespec string) []Activity
+	GetAuthorPosts(req *http.Request, actorId string) []Activity
+	GetTags(req *http.Request) []TagItem
+	GetTaggedPosts(req *http.Request, tag string) []Activity
+	SetOverride(req *http.Request, activityId string, o Override) error
+	GetOverrides(req *http.Request) map[string]Override
+	StoreMention(req *http.Request, m Mention)
+	DeleteMention(req *http.Request, source, activityId string)
+	GetMentions(req *http.Request, activityId string) []Mention
+	GetPendingMentions(req *http.Request) []Mention
+	AddFollower(req *http.Request, f Follower)
+	RemoveFollower(req *http.Request, actorId string)
+	GetFollowers(req *http.Request) []Follower
 }
 
 type ArchiveItem struct {
 	Datespec string
 	Count    int
+	Updated  string // the latest Updated of the posts
 }
 
 type ArchiveItemList []ArchiveItem
@@ -32,6 +62,23 @@ func (a ArchiveItemList) Less(i, j int) bool {
 }
 func (a ArchiveItemList) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 
+type TagItem struct {
+	Tag    string
+	Count  int
+	Weight int // 1..5, used for tag cloud
+}
+
+type TagItemList []TagItem
+
+func (t TagItemList) Len() int { return len(t) }
+func (t TagItemList) Less(i, j int) bool {
+	if t[i].Count != t[j].Count {
+		return t[i].Count > t[j].Count
+	}
+	return t[i].Tag < t[j].Tag
+}
+func (t TagItemList) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
 type latestActivityList struct {
 	a []Activity
 }
@@ -41,28 +88,34 @@ func (l *latestActivityList) Less(i, j int) bool {
 	return l.a[i].Published > l.a[j].Published
 }
 func (l *latestActivityList) Swap(i, j int) { l.a[i], l.a[j] = l.a[j], l.a[i] }
-func (l *latestActivityList) Push(x interface{}) {
-	l.a = append(l.a, x.(Activity))
-}
-func (l *latestActivityList) Pop() interface{} {
-	r := l.a[len(l.a)-1]
-	l.a = l.a[:len(l.a)-1]
-	return r
-}
 
 type MemStorage struct {
 	m      map[string]Activity   // activityid -> post
 	a      map[string][]Activity // datespec -> list of post
-	h      latestActivityList
+	u      map[string][]Activity // actorid -> list of post
+	t      map[string][]Activity // tag -> list of post
+	o      map[string]Override   // activityid -> override
+	sl     map[string]string     // datespec/slug -> activityid
+	l      map[string]string     // legacy key -> activityid
+	wm     map[string][]Mention  // activityid -> mentions
+	fo     map[string]Follower   // actor id -> follower
 	filter func(Activity) bool
+	templ  *AttachmentTemplates
+	hooks  []StoreHook
 	mu     sync.Mutex
 }
 
 func NewMemStorage() *MemStorage {
 	s := &MemStorage{
-		m: make(map[string]Activity),
-		a: make(map[string][]Activity)}
-	heap.Init(&s.h)
+		m:  make(map[string]Activity),
+		a:  make(map[string][]Activity),
+		u:  make(map[string][]Activity),
+		t:  make(map[string][]Activity),
+		o:  make(map[string]Override),
+		sl: make(map[string]string),
+		l:  make(map[string]string),
+		wm: make(map[string][]Mention),
+		fo: make(map[string]Follower)}
 	return s
 }
 
@@ -70,6 +123,53 @@ func (s *MemStorage) SetFilter(filter func(Activity) bool) {
 	s.filter = filter
 }
 
+// SetAttachmentTemplates sets the templates forming attachments of posts
+// stored hereafter; nil means DefaultAttachmentTemplates.
+func (s *MemStorage) SetAttachmentTemplates(templ *AttachmentTemplates) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.templ = templ
+}
+
+func (s *MemStorage) AddStoreHook(hook StoreHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+func runStoreHooks(hooks []StoreHook, req *http.Request, posts []Activity, reason StoreReason) {
+	if len(posts) == 0 {
+		return
+	}
+	for _, hook := range hooks {
+		hook(req, posts, reason)
+	}
+}
+
+// GetAllPosts returns all stored posts, newest month first.
+func GetAllPosts(s Storage, req *http.Request) []Activity {
+	var posts []Activity
+	for _, item := range s.GetDates(req) {
+		posts = append(posts, s.GetArchivedPosts(req, item.Datespec)...)
+	}
+	return posts
+}
+
+// GetStoredPosts returns all stored posts, including hidden ones
+// with their overrides, which GetAllPosts doesn't return.
+func GetStoredPosts(s Storage, req *http.Request) []Activity {
+	posts := GetAllPosts(s, req)
+	for id, o := range s.GetOverrides(req) {
+		if !o.Hidden {
+			continue
+		}
+		if post, found := s.GetPost(req, id); found {
+			posts = append(posts, post)
+		}
+	}
+	return posts
+}
+
 func GetDatespec(published string) string {
 	s := strings.Split(published, "-")
 	if len(s) >= 2 {
@@ -78,63 +178,353 @@ func GetDatespec(published string) string {
 	return ""
 }
 
+func replaceOrAppend(l []Activity, post Activity) []Activity {
+	for i, p := range l {
+		if p.Id == post.Id {
+			l[i] = post
+			return l
+		}
+	}
+	return append(l, post)
+}
+
+func removeActivity(l []Activity, activityId string) []Activity {
+	for i, p := range l {
+		if p.Id == activityId {
+			return append(l[:i], l[i+1:]...)
+		}
+	}
+	return l
+}
+
 func (s *MemStorage) StorePosts(req *http.Request, posts []Activity) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	changed := s.storePosts(posts)
+	hooks := s.hooks
+	s.mu.Unlock()
+	runStoreHooks(hooks, req, changed, StoreChanged)
+}
+
+// storePosts stores posts and returns new or updated ones. s.mu must be held.
+func (s *MemStorage) storePosts(posts []Activity) []Activity {
+	var changed []Activity
 	for _, post := range posts {
 		if s.filter != nil && !s.filter(post) {
 			continue
 		}
 		log.Printf("store: %s\n", post.Id)
-		s.m[post.Id] = post
-		updated := false
-		datespec := GetDatespec(post.Published)
-		for i, p := range s.a[datespec] {
-			if p.Id == post.Id {
-				s.a[datespec][i] = post
-				updated = true
-				break
+		PreparePost(&post, s.templ)
+		old, found := s.m[post.Id]
+		if found {
+			post.Slug = old.Slug
+			for _, tag := range old.Object.Tags {
+				s.t[tag] = removeActivity(s.t[tag], post.Id)
+				if len(s.t[tag]) == 0 {
+					delete(s.t, tag)
+				}
 			}
 		}
-		if !updated {
-			s.a[datespec] = append(s.a[datespec], post)
+		if !found {
+			assignSlug(&post, func(datespec, slug string) bool {
+				return s.slugUsed(datespec, slug, "")
+			})
+		}
+		s.sl[GetDatespec(post.Published)+"/"+post.Slug] = post.Id
+		if !found || old.Updated != post.Updated {
+			changed = append(changed, post)
+		}
+		for _, key := range LegacyKeys(post) {
+			s.l[key] = post.Id
+		}
+		s.m[post.Id] = post
+		for _, tag := range post.Object.Tags {
+			s.t[tag] = replaceOrAppend(s.t[tag], post)
 		}
-		heap.Push(&s.h, post)
-		if s.h.Len() >= 10 {
-			_ = heap.Remove(&s.h, s.h.Len()-1)
+		datespec := GetDatespec(post.Published)
+		s.a[datespec] = replaceOrAppend(s.a[datespec], post)
+		s.u[post.Actor.Id] = replaceOrAppend(s.u[post.Actor.Id], post)
+	}
+	return changed
+}
+
+// visible returns posts in l that are not hidden, with their overrides.
+// s.mu must be held.
+func (s *MemStorage) visible(l []Activity) []Activity {
+	var posts []Activity
+	for _, post := range l {
+		post.Override = s.o[post.Id]
+		if post.Override.Hidden {
+			continue
 		}
+		posts = append(posts, post)
 	}
+	return posts
 }
 
 func (s *MemStorage) GetLatestPosts(req *http.Request) []Activity {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.h.a
+	var all []Activity
+	for _, post := range s.m {
+		all = append(all, post)
+	}
+	return pinnedFirst(latestPosts(s.visible(all), 0), 10)
+}
+
+// GetPagedPosts returns at most limit posts from offset, newest first.
+// Unlike GetLatestPosts, pinned posts are not moved to the front.
+func (s *MemStorage) GetPagedPosts(req *http.Request, offset, limit int) []Activity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []Activity
+	for _, post := range s.m {
+		all = append(all, post)
+	}
+	posts := latestPosts(s.visible(all), 0)
+	if offset >= len(posts) {
+		return nil
+	}
+	posts = posts[offset:]
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+	return posts
 }
 
 func (s *MemStorage) GetPost(req *http.Request, activityId string) (Activity, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	a, ok := s.m[activityId]
+	a.Override = s.o[activityId]
+	return a, ok
+}
+
+func (s *MemStorage) GetPostBySlug(req *http.Request, datespec, slug string) (Activity, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	activityId := s.sl[datespec+"/"+slug]
+	a, ok := s.m[activityId]
+	a.Override = s.o[activityId]
 	return a, ok
 }
 
+func (s *MemStorage) GetPostByLegacyKey(req *http.Request, key string) (Activity, bool) {
+	s.mu.Lock()
+	activityId, found := s.l[key]
+	s.mu.Unlock()
+	if !found {
+		return Activity{}, false
+	}
+	return s.GetPost(req, activityId)
+}
+
 func (s *MemStorage) GetDates(req *http.Request) []ArchiveItem {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	var a ArchiveItemList
 	for datespec, l := range s.a {
-		a = append(a, ArchiveItem{Datespec: datespec, Count: len(l)})
+		posts := s.visible(l)
+		if len(posts) == 0 {
+			continue
+		}
+		item := ArchiveItem{Datespec: datespec, Count: len(posts)}
+		for _, post := range posts {
+			if item.Updated < post.Updated {
+				item.Updated = post.Updated
+			}
+		}
+		a = append(a, item)
 	}
 	sort.Sort(a)
 	return a
 }
 
+// GetArchivedPosts returns posts in the month datespec, "YYYY-MM",
+// or in the year "YYYY".
 func (s *MemStorage) GetArchivedPosts(req *http.Request, datespec string) []Activity {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if l, found := s.a[datespec]; found {
-		return l
+		return latestPosts(s.visible(l), 0)
+	}
+	var l []Activity
+	for d, posts := range s.a {
+		if strings.HasPrefix(d, datespec+"-") {
+			l = append(l, posts...)
+		}
+	}
+	return latestPosts(s.visible(l), 0)
+}
+
+func latestPosts(posts []Activity, n int) []Activity {
+	l := &latestActivityList{a: append([]Activity(nil), posts...)}
+	sort.Sort(l)
+	if n > 0 && l.Len() > n {
+		return l.a[:n]
+	}
+	return l.a
+}
+
+// pinnedFirst moves pinned posts to the front, keeping the order otherwise,
+// and returns at most n posts.
+func pinnedFirst(posts []Activity, n int) []Activity {
+	var pinned, others []Activity
+	for _, post := range posts {
+		if post.Override.Pinned {
+			pinned = append(pinned, post)
+		} else {
+			others = append(others, post)
+		}
+	}
+	posts = append(pinned, others...)
+	if n > 0 && len(posts) > n {
+		return posts[:n]
+	}
+	return posts
+}
+
+func (s *MemStorage) GetAuthorPosts(req *http.Request, actorId string) []Activity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return latestPosts(s.visible(s.u[actorId]), 10)
+}
+
+func (s *MemStorage) GetTags(req *http.Request) []TagItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var t TagItemList
+	for tag, l := range s.t {
+		if n := len(s.visible(l)); n > 0 {
+			t = append(t, TagItem{Tag: tag, Count: n})
+		}
+	}
+	sort.Sort(t)
+	return t
+}
+
+func (s *MemStorage) GetTaggedPosts(req *http.Request, tag string) []Activity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return latestPosts(s.visible(s.t[NormalizeTag(tag)]), 0)
+}
+
+// slugUsed reports whether slug is used in the month by a post other
+// than except, as a generated slug or an override. s.mu must be held.
+func (s *MemStorage) slugUsed(datespec, slug, except string) bool {
+	id, found := s.sl[datespec+"/"+slug]
+	return found && id != except
+}
+
+func (s *MemStorage) SetOverride(req *http.Request, activityId string, o Override) error {
+	if o.Slug != MakeSlug(o.Slug) {
+		return ErrBadSlug
+	}
+	s.mu.Lock()
+	post, found := s.m[activityId]
+	datespec := GetDatespec(post.Published)
+	if o.Slug != "" && s.slugUsed(datespec, o.Slug, activityId) {
+		s.mu.Unlock()
+		return ErrSlugTaken
+	}
+	unchanged := s.o[activityId] == o
+	if o == (Override{}) {
+		delete(s.o, activityId)
+	} else {
+		s.o[activityId] = o
+	}
+	if found && o.Slug != "" {
+		s.sl[datespec+"/"+o.Slug] = activityId
+	}
+	hooks := s.hooks
+	s.mu.Unlock()
+	if found && !unchanged {
+		post.Override = o
+		runStoreHooks(hooks, req, []Activity{post}, StoreOverridden)
 	}
 	return nil
 }
+
+func (s *MemStorage) GetOverrides(req *http.Request) map[string]Override {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	overrides := make(map[string]Override)
+	for id, o := range s.o {
+		overrides[id] = o
+	}
+	return overrides
+}
+
+func (s *MemStorage) StoreMention(req *http.Request, m Mention) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, old := range s.wm[m.PostId] {
+		if old.Source == m.Source {
+			s.wm[m.PostId][i] = m
+			return
+		}
+	}
+	s.wm[m.PostId] = append(s.wm[m.PostId], m)
+}
+
+func (s *MemStorage) DeleteMention(req *http.Request, source, activityId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.wm[activityId]
+	for i, m := range l {
+		if m.Source == source {
+			s.wm[activityId] = append(l[:i:i], l[i+1:]...)
+			return
+		}
+	}
+}
+
+// GetMentions returns mentions of the post, both approved and pending,
+// in the received order.
+func (s *MemStorage) GetMentions(req *http.Request, activityId string) []Mention {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Mention(nil), s.wm[activityId]...)
+}
+
+func (s *MemStorage) GetPendingMentions(req *http.Request) []Mention {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []Mention
+	for _, l := range s.wm {
+		for _, m := range l {
+			if !m.Approved {
+				pending = append(pending, m)
+			}
+		}
+	}
+	sort.Sort(mentionList(pending))
+	return pending
+}
+
+type mentionList []Mention
+
+func (l mentionList) Len() int           { return len(l) }
+func (l mentionList) Less(i, j int) bool { return l[i].Received < l[j].Received }
+func (l mentionList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func (s *MemStorage) AddFollower(req *http.Request, f Follower) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fo[f.Id] = f
+}
+
+func (s *MemStorage) RemoveFollower(req *http.Request, actorId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.fo, actorId)
+}
+
+func (s *MemStorage) GetFollowers(req *http.Request) []Follower {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var followers []Follower
+	for _, f := range s.fo {
+		followers = append(followers, f)
+	}
+	return followers
+}
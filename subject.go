@@ -0,0 +1,137 @@
+package blogplus
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+const maxSubjectLength = 100 // in runes
+
+// elements that break lines of the content.
+var lineBreakElements = map[string]bool{
+	"br": true, "p": true, "div": true, "li": true, "ul": true, "ol": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"blockquote": true, "pre": true, "hr": true, "table": true, "tr": true,
+	"dl": true, "dt": true, "dd": true, "figure": true, "figcaption": true,
+}
+
+// abbreviations whose "." doesn't end a sentence, in lower case.
+var abbreviations = []string{"mr", "mrs", "ms", "dr", "prof", "st", "jr", "sr", "vs", "e.g", "i.e", "no", "fig"}
+
+// closing quotes and brackets following the end of a sentence.
+const sentenceClosers = `"')]’”」』）】`
+
+// extractSubject sets the subject of post, the first sentence of the
+// first line of the sanitized content in plain text, or the title if the content
+// has no text. Invalid UTF-8 in the content is replaced with U+FFFD.
+func extractSubject(post *Activity) {
+	subject := truncateSubject(firstSentence(firstLine(strings.ToValidUTF8(post.Object.SanitizedContent, "\uFFFD"))))
+	if subject == "" {
+		subject = post.Title
+	}
+	post.Object.Subject = subject
+}
+
+// firstLine returns the first non-empty line of the text of content,
+// with spaces collapsed. Text in links, such as urls, hashtags and
+// mentions, is skipped.
+func firstLine(content string) string {
+	var line strings.Builder
+	inAnchor := 0
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt == html.TextToken {
+			if inAnchor == 0 {
+				line.Write(z.Text())
+			}
+			continue
+		}
+		name, _ := z.TagName()
+		switch {
+		case string(name) == "a" && tt == html.StartTagToken:
+			inAnchor++
+		case string(name) == "a" && tt == html.EndTagToken && inAnchor > 0:
+			inAnchor--
+		case lineBreakElements[string(name)]:
+			if s := strings.Join(strings.Fields(line.String()), " "); s != "" {
+				return s
+			}
+			line.Reset()
+		}
+	}
+	return strings.Join(strings.Fields(line.String()), " ")
+}
+
+// firstSentence returns the first sentence of line, including its
+// punctuation. "." ends a sentence only if followed by a space, so that
+// "v1.2" and urls are not cut, and not after abbreviations or initials.
+func firstSentence(line string) string {
+	runes := []rune(line)
+	for i, r := range runes {
+		// ascii punctuation needs a following space.
+		needSpace := false
+		switch r {
+		case '。', '！', '？', '｡':
+		case '.', '!', '?':
+			needSpace = true
+			if i+1 < len(runes) && runes[i+1] == r {
+				// "..." or "!!"
+				continue
+			}
+			if r == '.' && isAbbreviation(runes[:i]) {
+				continue
+			}
+		default:
+			continue
+		}
+		j := i + 1
+		for j < len(runes) && strings.ContainsRune(sentenceClosers, runes[j]) {
+			j++
+		}
+		if needSpace && j < len(runes) && !unicode.IsSpace(runes[j]) {
+			continue
+		}
+		return string(runes[:j])
+	}
+	return line
+}
+
+// isAbbreviation reports whether the word at the end of text is
+// an abbreviation or an initial.
+func isAbbreviation(text []rune) bool {
+	start := len(text)
+	for start > 0 && !unicode.IsSpace(text[start-1]) {
+		start--
+	}
+	word := strings.TrimLeft(string(text[start:]), `("'[“‘`)
+	if w := []rune(word); len(w) == 1 && unicode.IsUpper(w[0]) {
+		return true
+	}
+	return contains(abbreviations, strings.ToLower(word))
+}
+
+// truncateSubject cuts subject longer than maxSubjectLength.
+func truncateSubject(subject string) string {
+	runes := []rune(subject)
+	if len(runes) <= maxSubjectLength {
+		return subject
+	}
+	return strings.TrimSpace(string(runes[:cutPoint(runes, maxSubjectLength)])) + "…"
+}
+
+// cutPoint returns where to cut runes longer than n, at a word boundary
+// if any in the latter half, or at a rune boundary.
+func cutPoint(runes []rune, n int) int {
+	for i := n; i > n/2; i-- {
+		if unicode.IsSpace(runes[i]) {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,106 @@
+package blogplus
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestExtractSubject(t *testing.T) {
+	long := strings.Repeat("word ", 30)
+	for _, tc := range []struct {
+		name, content, title, want string
+	}{
+		{"sentence", "First sentence. Second sentence.", "", "First sentence."},
+		{"one sentence", "No punctuation here", "", "No punctuation here"},
+		{"first line", "Line one<br>Line two. More.", "", "Line one"},
+		{"paragraph", "<p>Para one</p><p>Para two</p>", "", "Para one"},
+		{"empty first line", "<br><br>  Text after breaks", "", "Text after breaks"},
+		{"spaces", "  Many \t spaces\nhere.  Next.", "", "Many spaces here."},
+		{"question", "Is it? Yes.", "", "Is it?"},
+		{"exclamation", "Wow! Really.", "", "Wow!"},
+		{"ellipsis", "Wait... what? Yes.", "", "Wait..."},
+		{"ellipsis no space", "Wait...what? Yes.", "", "Wait...what?"},
+		{"double exclamation", "Great!! Next.", "", "Great!!"},
+		{"quote closer", `He said "stop." Then left.`, "", `He said "stop."`},
+		{"paren closer", "It works (mostly.) Next.", "", "It works (mostly.)"},
+
+		// "." not ending sentences.
+		{"version", "Released v1.2 today. Enjoy.", "", "Released v1.2 today."},
+		{"version end", "Go 1.2.", "", "Go 1.2."},
+		{"decimal", "Pi is 3.14 roughly. Yes.", "", "Pi is 3.14 roughly."},
+		{"url text", "See example.com/a.b?c=d.e for details. Next.", "", "See example.com/a.b?c=d.e for details."},
+		{"linked url", `Check <a href="http://example.com/x.y">http://example.com/x.y</a> now. Next.`, "", "Check now."},
+		{"hashtag link", `Hello <a href="/tag/go">#go</a> world. Next.`, "", "Hello world."},
+		{"mr", "Mr. Smith went home. Then slept.", "", "Mr. Smith went home."},
+		{"dr", "Ask Dr. Who. Later.", "", "Ask Dr. Who."},
+		{"eg", "Fruits, e.g. apples. Others.", "", "Fruits, e.g. apples."},
+		{"initial", "J. R. R. Tolkien wrote it. Yes.", "", "J. R. R. Tolkien wrote it."},
+		{"no space after", "End.Next sentence. More.", "", "End.Next sentence."},
+
+		// CJK punctuation ends sentences without spaces.
+		{"maru", "日本語の文。次の文。", "", "日本語の文。"},
+		{"fullwidth exclamation", "すごい！次。", "", "すごい！"},
+		{"fullwidth question", "本当？はい。", "", "本当？"},
+		{"halfwidth maru", "ﾃｽﾄ｡つぎ", "", "ﾃｽﾄ｡"},
+		{"kagi closer", "「こんにちは。」と言った。", "", "「こんにちは。」"},
+
+		// entities are text.
+		{"entity", "Tom &amp; Jerry. Next.", "", "Tom & Jerry."},
+		{"entity lt", "1 &lt; 2 is true. Yes.", "", "1 < 2 is true."},
+		{"entity nbsp", "one&nbsp;two. three.", "", "one two."},
+		{"numeric entity", "&#x65E5;&#26412;。次", "", "日本。"},
+		{"tags", "<b>Bold</b> and <i>italic</i>. Next.", "", "Bold and italic."},
+
+		// the title if no text.
+		{"title", `<a href="http://example.com/">http://example.com/</a>`, "Shared link", "Shared link"},
+		{"empty", "", "", ""},
+
+		// cut at 100 runes.
+		{"cut at space", long, "", strings.TrimSpace(strings.Repeat("word ", 20)) + "…"},
+		{"exactly 100", strings.Repeat("a", 100), "", strings.Repeat("a", 100)},
+		{"cut no space", strings.Repeat("a", 150), "", strings.Repeat("a", 100) + "…"},
+		{"cut runes", strings.Repeat("あ", 150), "", strings.Repeat("あ", 100) + "…"},
+		{"cut before sentence end", strings.Repeat("a", 60) + " " + strings.Repeat("b", 60) + ". Next.", "", strings.Repeat("a", 60) + "…"},
+	} {
+		post := Activity{Title: tc.title, Object: Object{Content: tc.content}}
+		sanitizePost(&post)
+		extractSubject(&post)
+		if post.Object.Subject != tc.want {
+			t.Errorf("%s: subject of %q=%q; want %q", tc.name, tc.content, post.Object.Subject, tc.want)
+		}
+	}
+}
+
+func FuzzExtractSubject(f *testing.F) {
+	for _, s := range []string{
+		"First sentence. Second.",
+		"Mr. Smith v1.2 e.g. x",
+		"日本語の文。次！",
+		"<p>a<br>b</p><a href=x>link</a>",
+		"Tom &amp; Jerry &#x65E5;",
+		strings.Repeat("あい ", 80),
+		"<b>unclosed <i>",
+		"\xff\xfe invalid utf-8.",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, content string) {
+		post := Activity{Object: Object{Content: content}}
+		sanitizePost(&post)
+		extractSubject(&post)
+		subject := post.Object.Subject
+		if !utf8.ValidString(subject) {
+			t.Errorf("subject %q of %q is not valid UTF-8", subject, content)
+		}
+		if n := utf8.RuneCountInString(subject); n > maxSubjectLength+len("…") {
+			t.Errorf("subject of %q has %d runes", content, n)
+		}
+		if strings.ContainsAny(subject, "\n\r\t") {
+			t.Errorf("subject %q of %q has line breaks or tabs", subject, content)
+		}
+		if subject != strings.TrimSpace(subject) {
+			t.Errorf("subject %q of %q is not trimmed", subject, content)
+		}
+	})
+}
@@ -1,303 +1,234 @@
 package blogplus
 
 import (
+	"encoding/json"
 	"encoding/xml"
-	"html/template"
-	"io/ioutil"
 	"net/url"
-	"os"
-	"path/filepath"
-	text_template "text/template"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var (
-	BaseTempl       = template.New("base")
-	HeaderTempl     = BaseTempl.New("header")
-	headerTempl     = ""
-	EntryTempl      = BaseTempl.New("entry")
-	SidebarTempl    = BaseTempl.New("sidebar")
-	ArchiveTempl    = SidebarTempl.New("archive")
-	ArchivesJsTempl = text_template.New("archives.js")
-
-	ImageAttachmentTempl = template.New("image_attachment")
-	TextAttachmentTempl  = template.New("text_attachment")
-)
-
-const (
-	baseTempl = `<!DOCTYPE html>
-<html>
- <head>
-  <title>{{.Blogplus.Title}}{{.Title}}</title>
-  <link rel="me" type="text/html" href="{{.Blogplus.AuthorUri}}"/>
-  <link rel="alternate" type="application/atom+xml" title="RSS" href="{{.Blogplus.Prefix}}` + atomFeedPath + `"/>
-  {{template "header" .}}
-  <script type="text/javascript" src="{{.Blogplus.Prefix}}` + archivesJsPath + `"></script>
-  <script type="text/javascript" src="https://apis.google.com/js/plusone.js"></script>
- </head>
- <body>
-  <div id="content">
-   <h1><a itemprop="name" href="{{.Blogplus.Prefix}}` + mainPath + `">{{.Blogplus.Title}}</a></h1>
-   <div id="main">
-   {{if .Posts }}
-    {{range .Posts}}{{template "entry" .}}{{end}} 
-   {{else}}
-    {{template "entry" .Post}}
-   {{end}}
-   </div>
-   <div id="sidebar">
-     {{template "sidebar" .}}
-   </div>
-  </div>
- </body>
-</html>
-`
-
-	entryTempl      = `
- <div class="post">
-  <div class="content">{{.Object.HTMLContent}}</div>
-  {{if .FormedAttachment }}
-  <div class="attachments">
-   <hr class="attachment">
-   {{.HTMLFormedAttachment}}
-  </div>
-  {{end}}
-  <div class="meta">
-   <span class="date">{{.Published}}</span>
-   <span class="permalink"><a href="{{.Permalink}}">permalink</a></span>
-   <span class="original_post"><a target="_blank" href="{{.Url}}">original post</a></span> |
-    {{if .Object.PlusOners.TotalItems }}
-      <span class="plusones"><a href="{{.Url}}">+{{.Object.PlusOners.TotalItems}}</a></span>
-    {{end}}
-    {{if .Object.Resharers.TotalItems }}
-      <span class="reshares"><a href="{{.Url}}">{{.Object.Resharers.TotalItems}} reshares</a></span>
-    {{end}}
-    {{if .Object.Replies.TotalItems }}
-      <span class="replies"><a href="{{.Url}}">{{.Object.Replies.TotalItems}} replies</a></span>
-    {{end}}
-    <g:plusone size="small" href="{{.Permalink}}"></g:plusone>
-  </div>
-  <hr class="entry" />
- </div>
-`
-	sidebarTempl    = `{{template "archive" .}}`
-	archiveTempl    = `<h2>Archives</h2>
-<div class="content">
- <select id="select_archive">
-   <option value=""></option>
-   {{range .ArchiveItems}}
-   <option value="{{.Datespec}}">{{.Datespec}} ({{.Count}})</option>
-   {{end}}
- </select>
-</div>
-`
-	archivesJsTempl = `
-(function() {
-function redirectToArchive(e) {
-  if (!e.target.value)
-    return;
-  window.location.href = '{{.ServerRootURL}}` + archivePath + `' + e.target.value;
-}
-window.addEventListener('load', function() {
-  var selector = document.getElementById('select_archive');
-  selector.addEventListener('change', redirectToArchive);
-});
-})()
-`
-
-	imageAttachmentTempl = `<a href="{{.Url}}"><img src="{{.Image.Url}}"></a>
-{{if .DisplayName}}<a href="{{.Url}}">{{.DisplayName}}</a>{{end}}`
-	textAttachmentTempl  = `{{if .VisualAttachments}}
-<div>
-{{range .VisualAttachments}}
-<a href="{{.Url}}"><img src="{{.Image.Url}}"></a><br>
-{{end}}
-</div>
-{{end}}
-<div>
-{{range .TextAttachments}}
-<div>
-<a href="{{.Url}}">{{.HTMLDisplayName}}</a><br>{{.Content}}
-</div>
-{{end}}
-</div>`
-
-	styleCss = `
-/* style */
-h1 {
-    font-family: sans-serif;
-}
-
-h1 a {
-    color: 'black';
-    width: 100%;
-}
-
-#sidebar h2 {
-    font-family: serif;
-    font-size: medium;
-    text-decoration:none;
-    border-bottom:solid black 1px;
-}
-
-h1 a:hover {
-    text-decoration:none;
-}
-
-div.post {
-    width: 97%;
-}
-
-hr {
-    border-color:green;
-}
-
-hr.entry {
-    margin-bottom: 7ex;
-}
-
-div.attachments {
-    margin-left:10%;
-}
-
-div.meta {
-    font-family: serif;
-    background-color:#EEE;
-}
-
-#main div.content {
-    word-wrap: break-word;
-}
+type TemplateContext struct {
+	Posts        []Activity
+	Post         Activity
+	ArchiveItems []ArchiveItem
+	TagItems     []TagItem
+	ServerRoot   *url.URL // include prefix
+	Title        string   // of the page, including the title of the blog
 
-#sidebar div.content {
-    margin-left: 5px;
+	GlobalUpdated string
+	FeedPath      string // relative to ServerRoot; atomFeedPath if empty
+	FeedPage      int    // page number of the paged feed, or 0
+	FeedLastPage  int
+	FeedComplete  bool   // the feed has all posts
+	Archive       string // datespec of the archive page
+	Home          bool   // the home page
+	*Blogplus
 }
 
-#content {
-    margin-left: 4ex;
+// tagCloud assigns Weight to each item, relative to the most used tag.
+func tagCloud(items []TagItem) []TagItem {
+	max := 0
+	for _, item := range items {
+		if item.Count > max {
+			max = item.Count
+		}
+	}
+	for i := range items {
+		items[i].Weight = 1
+		if max > 1 {
+			items[i].Weight += 4 * (items[i].Count - 1) / (max - 1)
+		}
+	}
+	return items
 }
 
-#main {
-   max-width: 640px;
-   border-right: 1px solid #BBB;
-   float:left;
-   line-height: 1.7em;
+func (tc *TemplateContext) ServerRootURL() string {
+	return tc.ServerRoot.String()
 }
 
-#sidebar {
-    max-width: 320px;
-    float:left;
+// HubURL returns the url of the WebSub hub, or "".
+func (tc *TemplateContext) HubURL() string {
+	return tc.Blogplus.hubURL(tc.ServerRoot)
 }
-`
-)
 
-func init() {
-	_, err := BaseTempl.Parse(baseTempl)
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = HeaderTempl.Parse(headerTempl)
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = EntryTempl.Parse(entryTempl)
-	if err != nil {
-		panic(err)
+func GetAtomFeed(tc *TemplateContext) (data []byte, err error) {
+	root := tc.ServerRoot.String()
+	feedId := root
+	feedUrl := root + atomFeedPath
+	alternate := root
+	if tc.FeedPath != "" {
+		feedUrl = root + tc.FeedPath
+		if tc.FeedPage == 0 && !tc.FeedComplete {
+			// author or tag feed.
+			feedId = feedUrl
+			alternate = root + strings.TrimSuffix(tc.FeedPath, atomFeedPath)
+		}
 	}
-
-	_, err = SidebarTempl.Parse(sidebarTempl)
-	if err != nil {
-		panic(err)
+	feed := AtomFeed{
+		Base:    root + "/",
+		Id:      feedId,
+		Title:   tc.Blogplus.Title,
+		Updated: tc.GlobalUpdated,
+		Logo:    tc.Blogplus.LogoUrl}
+	// atom requires the author of the feed, unless every entry has one.
+	feed.Author = &AtomAuthor{
+		Name: tc.Blogplus.AuthorName,
+		Uri:  tc.Blogplus.AuthorUri}
+	if feed.Author.Name == "" {
+		feed.Author = &AtomAuthor{
+			Name: tc.Blogplus.Title,
+			Uri:  root + "/"}
+		if feed.Author.Name == "" {
+			feed.Author.Name = tc.ServerRoot.Host
+		}
 	}
-
-	_, err = ArchiveTempl.Parse(archiveTempl)
-	if err != nil {
-		panic(err)
+	feed.Link = append(feed.Link, AtomLink{Href: alternate, Rel: "alternate", Type: "text/html"})
+	feed.Link = append(feed.Link, AtomLink{Href: feedUrl, Rel: "self", Type: "application/atom+xml"})
+	if hub := tc.HubURL(); hub != "" {
+		feed.Link = append(feed.Link, AtomLink{Href: hub, Rel: "hub"})
 	}
-
-	_, err = ArchivesJsTempl.Parse(archivesJsTempl)
-	if err != nil {
-		panic(err)
+	if tc.FeedPage > 0 {
+		// RFC 5005 paged feed.
+		feed.Link = append(feed.Link, AtomLink{Href: feedPageUrl(root, 1), Rel: "first"})
+		feed.Link = append(feed.Link, AtomLink{Href: feedPageUrl(root, tc.FeedLastPage), Rel: "last"})
+		if tc.FeedPage > 1 {
+			feed.Link = append(feed.Link, AtomLink{Href: feedPageUrl(root, tc.FeedPage-1), Rel: "previous"})
+		}
+		if tc.FeedPage < tc.FeedLastPage {
+			feed.Link = append(feed.Link, AtomLink{Href: feedPageUrl(root, tc.FeedPage+1), Rel: "next"})
+		}
 	}
-
-	_, err = ImageAttachmentTempl.Parse(imageAttachmentTempl)
-	if err != nil {
-		panic(err)
+	if tc.FeedComplete {
+		feed.Complete = &struct{}{}
 	}
-
-	_, err = TextAttachmentTempl.Parse(textAttachmentTempl)
-	if err != nil {
-		panic(err)
+	for _, post := range tc.Posts {
+		e := AtomEntry{
+			// keep the id-based url, so that entry ids don't change with slugs.
+			Id:    root + postPath + post.Id,
+			Title: post.Object.Subject,
+			Content: AtomContent{
+				Content: post.Object.SanitizedContent,
+				Type:    "html"},
+			Summary: AtomText{
+				Text: post.Object.Excerpt,
+				Type: "text"},
+			Published: post.Published,
+			Updated:   post.Updated}
+		e.Link = append(e.Link, AtomLink{Href: post.Permalink, Rel: "alternate", Type: "text/html"})
+		for _, enclosure := range post.Enclosures() {
+			e.Link = append(e.Link, AtomLink{Href: enclosure.Url, Rel: "enclosure", Type: enclosure.Type})
+		}
+		if post.Actor.DisplayName != "" {
+			e.Author = &AtomAuthor{
+				Name: post.Actor.DisplayName,
+				Uri:  post.Actor.Url}
+		}
+		for _, tag := range post.Object.Tags {
+			e.Categories = append(e.Categories, AtomCategory{
+				Term:   tag,
+				Scheme: root + tagPath,
+				Label:  "#" + tag})
+		}
+		feed.Entries = append(feed.Entries, e)
 	}
+	return xml.Marshal(feed)
 }
 
-func createTempl(dir, path, templ string) {
-	err := ioutil.WriteFile(filepath.Join(dir, path),
-		[]byte(templ), os.FileMode(0644))
-	if err != nil {
-		panic(err)
+// feedPageUrl returns the url of page of the paged atom feed.
+func feedPageUrl(root string, page int) string {
+	if page <= 1 {
+		return root + atomFeedPath
 	}
+	return root + feedPagePath + strconv.Itoa(page)
 }
 
-func loadTempl(dir, path string, templ *template.Template) {
-	data, err := ioutil.ReadFile(filepath.Join(dir, path))
+func rfc822(rfc3339 string) string {
+	t, err := time.Parse(time.RFC3339, rfc3339)
 	if err != nil {
-		panic(err)
+		return ""
 	}
-	_, err = templ.Parse(string(data))
-	if err != nil {
-		panic(err)
+	return t.Format(time.RFC1123Z)
+}
+
+func GetRSSFeed(tc *TemplateContext) (data []byte, err error) {
+	feed := RSSFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		Channel: RSSChannel{
+			Title:         tc.Blogplus.Title,
+			Link:          tc.ServerRoot.String(),
+			Description:   tc.Blogplus.Title,
+			LastBuildDate: rfc822(tc.GlobalUpdated),
+			AtomLinks: []RSSAtomLink{{
+				Href: tc.ServerRoot.String() + rssFeedPath,
+				Rel:  "self",
+				Type: "application/rss+xml"}}}}
+	if hub := tc.HubURL(); hub != "" {
+		feed.Channel.AtomLinks = append(feed.Channel.AtomLinks, RSSAtomLink{Href: hub, Rel: "hub"})
+	}
+	for _, post := range tc.Posts {
+		item := RSSItem{
+			Title: post.Object.Subject,
+			Link:  post.Permalink,
+			Guid: RSSGuid{
+				Guid: tc.ServerRoot.String() + postPath + post.Id},
+			Description: post.Object.SanitizedContent,
+			PubDate:     rfc822(post.Published),
+			Categories:  post.Object.Tags}
+		if enclosures := post.Enclosures(); len(enclosures) > 0 {
+			// RSS allows only one enclosure per item.
+			item.Enclosure = &RSSEnclosure{
+				Url:  enclosures[0].Url,
+				Type: enclosures[0].Type}
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
 	}
+	return xml.Marshal(feed)
 }
 
-func loadTextTempl(dir, path string, templ *text_template.Template) {
-	data, err := ioutil.ReadFile(filepath.Join(dir, path))
-	if err != nil {
-		panic(err)
+func GetJSONFeed(tc *TemplateContext) (data []byte, err error) {
+	feed := JSONFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       tc.Blogplus.Title,
+		HomePageUrl: tc.ServerRoot.String(),
+		FeedUrl:     tc.ServerRoot.String() + jsonFeedPath,
+		Icon:        tc.Blogplus.LogoUrl,
+		Items:       []JSONFeedItem{}}
+	if hub := tc.HubURL(); hub != "" {
+		feed.Hubs = []JSONFeedHub{{Type: "WebSub", Url: hub}}
 	}
-	_, err = templ.Parse(string(data))
-	if err != nil {
-		panic(err)
+	if tc.Blogplus.AuthorName != "" {
+		feed.Authors = []JSONFeedAuthor{{
+			Name: tc.Blogplus.AuthorName,
+			Url:  tc.Blogplus.AuthorUri}}
 	}
-}
-
-type TemplateContext struct {
-	Posts        []Activity
-	Post         Activity
-	ArchiveItems []ArchiveItem
-	ServerRoot   *url.URL // include prefix
-	Title        string
-
-	GlobalUpdated string
-	*Blogplus
-}
-
-func (tc *TemplateContext) ServerRootURL() string {
-	return tc.ServerRoot.String()
-}
-
-func GetAtomFeed(tc *TemplateContext) (data []byte, err error) {
-	feed := AtomFeed{
-		Id:         tc.ServerRoot.String(),
-		Title:      tc.Blogplus.Title,
-		Updated:    tc.GlobalUpdated,
-		AuthorName: tc.Blogplus.AuthorName,
-		AuthorUri:  tc.Blogplus.AuthorUri,
-		Logo:       tc.Blogplus.LogoUrl}
-	feed.Link = append(feed.Link, AtomLink{Href: tc.ServerRoot.String()})
-	feed.Link = append(feed.Link, AtomLink{Href: tc.ServerRoot.String() + atomFeedPath, Rel: "self"})
 	for _, post := range tc.Posts {
-		e := AtomEntry{
-			Id:    post.Permalink,
-			Title: post.Object.Subject,
-			Content: AtomContent{
-				Content: post.Object.Content,
-				Type:    "html"},
-			Summary:   post.Object.Content,
-			Published: post.Published,
-			Updated:   post.Updated}
-		feed.Entries = append(feed.Entries, e)
+		item := JSONFeedItem{
+			Id:            tc.ServerRoot.String() + postPath + post.Id,
+			Url:           post.Permalink,
+			Title:         post.Object.Subject,
+			ContentHTML:   post.Object.SanitizedContent,
+			Summary:       post.Object.Excerpt,
+			DatePublished: post.Published,
+			DateModified:  post.Updated,
+			Tags:          post.Object.Tags}
+		if post.Actor.DisplayName != "" {
+			item.Authors = []JSONFeedAuthor{{
+				Name:   post.Actor.DisplayName,
+				Url:    post.Actor.Url,
+				Avatar: post.Actor.Image.Url}}
+		}
+		for _, enclosure := range post.Enclosures() {
+			if item.Image == "" {
+				item.Image = enclosure.Url
+			}
+			item.Attachments = append(item.Attachments, JSONFeedAttachment{
+				Url:      enclosure.Url,
+				MimeType: enclosure.Type})
+		}
+		feed.Items = append(feed.Items, item)
 	}
-	return xml.Marshal(feed)
+	return json.MarshalIndent(feed, "", " ")
 }
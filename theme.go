@@ -0,0 +1,362 @@
+package blogplus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	text_template "text/template"
+	"time"
+)
+
+const themePath = "/theme/"
+
+//go:embed theme
+var defaultThemeFiles embed.FS
+
+// Theme is a set of templates and assets of the blog in an fs.FS,
+// such as a directory (see DirTheme) or an embed.FS (see NewTheme).
+//
+// The page templates are base.tmpl, header.tmpl, entry.tmpl, sidebar.tmpl,
+// archive.tmpl, tagcloud.tmpl and archives.js.tmpl. Other files, such as
+// style.css and images, are assets served at /theme/, with urls returned
+// by Blogplus.Asset that change with their content.
+// Files missing in the theme are taken from Parent.
+// Dir, if set, is the directory of FS, shown in template errors.
+//
+// image_attachment.tmpl and text_attachment.tmpl are not page templates,
+// since attachments are formed when posts are stored; see
+// ParseAttachmentTemplates.
+//
+// If AssetsOnly is set, as for the static dir, FS only provides assets:
+// templates in it are ignored, and so are files larger than maxAssetSize
+// or of types other than assetTypes.
+type Theme struct {
+	FS         fs.FS
+	Dir        string
+	Parent     *Theme
+	AssetsOnly bool
+}
+
+// limits of assets of AssetsOnly themes, since they are kept in memory.
+const maxAssetSize = 1 << 20
+
+var assetTypes = map[string]bool{
+	".css": true, ".js": true, ".json": true, ".txt": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".svg": true, ".ico": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true,
+}
+
+// has reports whether t may provide name, regardless of the parent.
+func (t *Theme) has(name string) bool {
+	return !t.AssetsOnly || !strings.HasSuffix(name, ".tmpl")
+}
+
+// DefaultTheme is the built-in theme.
+var DefaultTheme = &Theme{FS: mustSub(defaultThemeFiles, "theme")}
+
+// NewTheme returns the theme of fsys, inheriting DefaultTheme.
+func NewTheme(fsys fs.FS) *Theme {
+	return &Theme{FS: fsys, Parent: DefaultTheme}
+}
+
+// DirTheme returns the theme of dir, inheriting DefaultTheme.
+func DirTheme(dir string) *Theme {
+	return &Theme{FS: os.DirFS(dir), Dir: dir, Parent: DefaultTheme}
+}
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// ReadFile reads name from t, or from its ancestors if t doesn't have it.
+func (t *Theme) ReadFile(name string) ([]byte, error) {
+	for ; t != nil; t = t.Parent {
+		if !t.has(name) {
+			continue
+		}
+		data, err := fs.ReadFile(t.FS, name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return data, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// filename returns the file name of name in t or its ancestors,
+// or "" if missing.
+func (t *Theme) filename(name string) string {
+	for ; t != nil; t = t.Parent {
+		if !t.has(name) {
+			continue
+		}
+		if _, err := fs.Stat(t.FS, name); err != nil {
+			continue
+		}
+		if t.Dir != "" {
+			return filepath.Join(t.Dir, filepath.FromSlash(name))
+		}
+		return name
+	}
+	return ""
+}
+
+// assets returns the names of assets in t and its ancestors, mapped to
+// the themes providing them. hidden files are skipped, and so are files
+// AssetsOnly themes don't allow.
+func (t *Theme) assets() (map[string]*Theme, error) {
+	assets := make(map[string]*Theme)
+	for ; t != nil; t = t.Parent {
+		err := fs.WalkDir(t.FS, ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p != "." && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() || strings.HasSuffix(p, ".tmpl") || assets[p] != nil {
+				return nil
+			}
+			if t.AssetsOnly {
+				if !assetTypes[strings.ToLower(path.Ext(p))] {
+					return nil
+				}
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				if info.Size() > maxAssetSize {
+					return nil
+				}
+			}
+			assets[p] = t
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return assets, nil
+}
+
+type themeAsset struct {
+	data []byte
+	hash string
+}
+
+// themeTemplates is a theme parsed for rendering.
+type themeTemplates struct {
+	theme      *Theme
+	base       *template.Template
+	archivesJs *text_template.Template
+	assets     map[string]themeAsset
+}
+
+// templates executed in base.tmpl.
+var pageTemplates = []string{"header", "entry", "sidebar", "archive", "tagcloud"}
+
+// parseTheme parses the templates and reads the assets of t.
+func parseTheme(t *Theme) (*themeTemplates, error) {
+	tt := &themeTemplates{theme: t, assets: make(map[string]themeAsset)}
+	data, err := t.ReadFile("base.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	tt.base, err = template.New("base").Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range pageTemplates {
+		data, err = t.ReadFile(name + ".tmpl")
+		if err != nil {
+			return nil, err
+		}
+		_, err = tt.base.New(name).Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err = t.ReadFile("archives.js.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	tt.archivesJs, err = text_template.New("archives.js").Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	assets, err := t.assets()
+	if err != nil {
+		return nil, err
+	}
+	for name, at := range assets {
+		data, err = fs.ReadFile(at.FS, name)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		tt.assets[name] = themeAsset{data: data, hash: hex.EncodeToString(sum[:6])}
+	}
+	return tt, nil
+}
+
+var (
+	defaultTemplatesOnce sync.Once
+	defaultTemplates     *themeTemplates
+)
+
+// templates returns the parsed theme of b, DefaultTheme if not set.
+func (b *Blogplus) templates() *themeTemplates {
+	b.themeMu.RLock()
+	tt := b.theme
+	b.themeMu.RUnlock()
+	if tt != nil {
+		return tt
+	}
+	defaultTemplatesOnce.Do(func() {
+		var err error
+		defaultTemplates, err = parseTheme(DefaultTheme)
+		if err != nil {
+			panic(err)
+		}
+	})
+	return defaultTemplates
+}
+
+// Theme returns the theme of b.
+func (b *Blogplus) Theme() *Theme {
+	b.themeMu.RLock()
+	t := b.themeSrc
+	b.themeMu.RUnlock()
+	if t != nil {
+		return t
+	}
+	return b.templates().theme
+}
+
+// SetTheme sets the theme of b. It returns an error, and b keeps
+// the current theme, if templates of t fail to parse.
+// In development mode, t is set even then, so that it is parsed again
+// by WatchTheme, while pages are rendered with the last good templates
+// and the error.
+func (b *Blogplus) SetTheme(t *Theme) error {
+	tt, err := parseTheme(t)
+	b.themeMu.Lock()
+	if err != nil {
+		if b.Dev {
+			b.themeSrc = t
+			b.themeErr = newTemplateError("parse", t, err)
+		}
+		b.themeMu.Unlock()
+		return err
+	}
+	b.theme, b.themeSrc, b.themeErr = tt, t, nil
+	b.themeMu.Unlock()
+	b.cache.flush()
+	return nil
+}
+
+// Asset returns the url of the asset name of the theme, or "" if missing.
+// The url has the hash of the content, so that it can be cached long.
+func (b *Blogplus) Asset(name string) string {
+	asset, found := b.templates().assets[name]
+	if !found {
+		return ""
+	}
+	return b.Prefix + themePath + name + "?v=" + asset.hash
+}
+
+// ServeThemeAsset serves the assets of the theme at /theme/.
+func (b *Blogplus) ServeThemeAsset(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, b.Prefix+themePath)
+	asset, found := b.templates().assets[name]
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+	if req.URL.Query().Get("v") == asset.hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	if typ := mime.TypeByExtension(path.Ext(name)); typ != "" {
+		w.Header().Set("Content-Type", typ)
+	}
+	w.Header().Set("ETag", `"`+asset.hash+`"`)
+	http.ServeContent(w, req, name, time.Time{}, bytes.NewReader(asset.data))
+}
+
+// AttachmentTemplates are the templates forming attachments of posts.
+// Unlike page templates, they are used by Storage when posts are stored;
+// see Storage.SetAttachmentTemplates and Reprocess.
+type AttachmentTemplates struct {
+	Image *template.Template
+	Text  *template.Template
+}
+
+// DefaultAttachmentTemplates are those of DefaultTheme.
+var DefaultAttachmentTemplates = mustParseAttachmentTemplates(DefaultTheme)
+
+// ParseAttachmentTemplates parses image_attachment.tmpl and
+// text_attachment.tmpl of t.
+func ParseAttachmentTemplates(t *Theme) (*AttachmentTemplates, error) {
+	image, err := parseAttachmentTempl(t, "image_attachment")
+	if err != nil {
+		return nil, err
+	}
+	text, err := parseAttachmentTempl(t, "text_attachment")
+	if err != nil {
+		return nil, err
+	}
+	return &AttachmentTemplates{Image: image, Text: text}, nil
+}
+
+func parseAttachmentTempl(t *Theme, name string) (*template.Template, error) {
+	data, err := t.ReadFile(name + ".tmpl")
+	if err != nil {
+		return nil, err
+	}
+	return template.New(name).Parse(string(data))
+}
+
+func mustParseAttachmentTemplates(t *Theme) *AttachmentTemplates {
+	templ, err := ParseAttachmentTemplates(t)
+	if err != nil {
+		panic(err)
+	}
+	return templ
+}
+
+// ExtractTheme writes the files of DefaultTheme into dir, to be
+// modified and used with DirTheme. Existing files are overwritten.
+func ExtractTheme(dir string) error {
+	return fs.WalkDir(DefaultTheme.FS, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		filename := filepath.Join(dir, filepath.FromSlash(p))
+		if d.IsDir() {
+			return os.MkdirAll(filename, os.FileMode(0755))
+		}
+		data, err := fs.ReadFile(DefaultTheme.FS, p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filename, data, os.FileMode(0644))
+	})
+}
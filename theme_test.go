@@ -0,0 +1,57 @@
+package blogplus
+
+import (
+	"html/template"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestAssetsOnlyTheme(t *testing.T) {
+	b, _ := newTestBlogplus()
+	static := fstest.MapFS{
+		"style.css":   {Data: []byte("body { color: red }")},
+		"favicon.png": {Data: []byte(strings.Repeat("x", maxAssetSize+1))},
+		"notes.md":    {Data: []byte("# notes")},
+		"base.tmpl":   {Data: []byte("overridden")},
+	}
+	err := b.SetTheme(&Theme{FS: static, Parent: DefaultTheme, AssetsOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b.templates().assets["style.css"].data); got != "body { color: red }" {
+		t.Errorf("style.css = %q; want the one in the static dir", got)
+	}
+	for _, name := range []string{"favicon.png", "notes.md", "base.tmpl"} {
+		if u := b.Asset(name); u != "" {
+			t.Errorf("Asset(%q) = %q; want none", name, u)
+		}
+	}
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if strings.Contains(w.Body.String(), "overridden") {
+		t.Errorf("base.tmpl in the static dir is used:\n%s", w.Body)
+	}
+}
+
+func TestAttachmentTemplatesPerStorage(t *testing.T) {
+	s1, s2 := NewMemStorage(), NewMemStorage()
+	s1.SetAttachmentTemplates(&AttachmentTemplates{
+		Image: template.Must(template.New("image_attachment").Parse(`<custom src="{{.Image.Url}}">`)),
+		Text:  DefaultAttachmentTemplates.Text,
+	})
+	post := testPost("at1", time.Now(), "Photo post")
+	post.Object.Attachments = []Attachment{{ObjectType: "photo", Url: "http://example.com/p", Image: Image{Url: "http://example.com/p.jpg"}}}
+	s1.StorePosts(nil, []Activity{post})
+	s2.StorePosts(nil, []Activity{post})
+	p1, _ := s1.GetPost(nil, "at1")
+	p2, _ := s2.GetPost(nil, "at1")
+	if want := `<custom src="http://example.com/p.jpg">`; p1.FormedAttachment != want {
+		t.Errorf("with custom templates: %q; want %q", p1.FormedAttachment, want)
+	}
+	if !strings.Contains(p2.FormedAttachment, `<img class="u-photo" src="http://example.com/p.jpg">`) {
+		t.Errorf("with default templates: %q", p2.FormedAttachment)
+	}
+}
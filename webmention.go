@@ -0,0 +1,410 @@
+package blogplus
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Webmention: https://www.w3.org/TR/webmention/
+
+const (
+	webmentionPath = "/webmention"
+
+	// maxFetchSize limits the size of pages fetched for Webmention.
+	maxFetchSize = 1 << 20
+
+	maxMentionTitleLength = 100 // in runes
+
+	// maxMentionVerifications limits received Webmentions being verified.
+	maxMentionVerifications = 8
+
+	// maxNotifyAge limits the age of posts to notify others of, by
+	// Webmention or ActivityPub. Older posts are taken as imported, e.g.
+	// by the first fetch of the stream, rather than new.
+	maxNotifyAge = 7 * 24 * time.Hour
+)
+
+var (
+	hrefRe       = regexp.MustCompile(`(?is)<a\s[^>]*?href\s*=\s*["']([^"']*)["']`)
+	linkHeaderRe = regexp.MustCompile(`<([^>]*)>\s*;\s*rel\s*=\s*"?([^";]*)"?`)
+	relTagRe     = regexp.MustCompile(`(?is)<(?:link|a)\s[^>]*>`)
+	relAttrRe    = regexp.MustCompile(`(?is)\srel\s*=\s*["']([^"']*)["']`)
+	hrefAttrRe   = regexp.MustCompile(`(?is)\shref\s*=\s*["']([^"']*)["']`)
+	titleRe      = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	metaAuthorRe = regexp.MustCompile(`(?is)<meta\s+name\s*=\s*["']author["']\s+content\s*=\s*["']([^"']*)["']`)
+
+	// webmentionClient fetches urls given by others.
+	webmentionClient = newPublicClient()
+)
+
+// newPublicClient returns a client for urls given by others, which
+// doesn't connect to internal addresses; see dialPublicOnly.
+func newPublicClient() *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+				Control: dialPublicOnly,
+			}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second}}
+}
+
+// dialPublicOnly is net.Dialer.Control to refuse connections to loopback,
+// private, link-local and other non-public addresses. It checks the
+// resolved address, so host names resolving to them are refused too.
+func dialPublicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("non-public address %s", address)
+	}
+	return nil
+}
+
+// isPublicIP reports whether ip is a global unicast address,
+// not in private networks.
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		// shared address space for carrier-grade NAT, 100.64.0.0/10.
+		if ip[0] == 100 && ip[1]&0xc0 == 64 {
+			return false
+		}
+	}
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// isRecent reports whether post is updated within maxNotifyAge.
+func isRecent(post Activity) bool {
+	t, err := time.Parse(time.RFC3339, post.Updated)
+	return err == nil && time.Since(t) < maxNotifyAge
+}
+
+// Mention is a Webmention received for a post.
+type Mention struct {
+	Source   string
+	Target   string
+	PostId   string
+	Title    string // title of the source page
+	Author   string
+	Received string // RFC3339 timestamp
+	Approved bool   // shown under the post
+}
+
+// Host returns the host of the source.
+func (m Mention) Host() string {
+	if u, err := url.Parse(m.Source); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+// outgoingLinks returns the urls linked from post, except the blog itself.
+func outgoingLinks(post Activity, serverRoot *url.URL) []string {
+	var links []string
+	seen := make(map[string]bool)
+	add := func(link string) {
+		u, err := url.Parse(link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == serverRoot.Host {
+			return
+		}
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	for _, m := range hrefRe.FindAllStringSubmatch(post.Object.SanitizedContent, -1) {
+		add(html.UnescapeString(m[1]))
+	}
+	for _, attachment := range post.Object.Attachments {
+		add(attachment.Url)
+	}
+	return links
+}
+
+// sendWebmentions is a StoreHook to send Webmentions for the links in
+// posts, when they are new or updated. Changes of overrides, such as pins,
+// and posts older than maxNotifyAge are not notified.
+func (b *Blogplus) sendWebmentions(req *http.Request, posts []Activity, reason StoreReason) {
+	if !b.Webmention || reason != StoreChanged {
+		return
+	}
+	serverRoot := getServerRoot(b, req)
+	if serverRoot.Host == "" {
+		log.Println("webmention: unknown host, not sent")
+		return
+	}
+	for _, post := range posts {
+		if post.Override.Hidden || !isRecent(post) {
+			continue
+		}
+		processPost(&post, serverRoot)
+		links := outgoingLinks(post, serverRoot)
+		if len(links) == 0 {
+			continue
+		}
+		go func(source string, targets []string) {
+			for _, target := range targets {
+				err := sendWebmention(source, target)
+				if err != nil {
+					log.Println("webmention:", target, err)
+				}
+			}
+		}(post.Permalink, links)
+	}
+}
+
+// sendWebmention notifies the Webmention endpoint of target, if any.
+func sendWebmention(source, target string) error {
+	endpoint, err := discoverWebmention(target)
+	if err != nil || endpoint == "" {
+		return err
+	}
+	resp, err := webmentionClient.PostForm(endpoint, url.Values{
+		"source": {source},
+		"target": {target}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Println("webmention:", endpoint, resp.Status)
+	}
+	return nil
+}
+
+// discoverWebmention returns the Webmention endpoint of target,
+// or "" if it has none.
+func discoverWebmention(target string) (string, error) {
+	resp, err := webmentionClient.Get(target)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", nil
+	}
+	base := resp.Request.URL
+	for _, link := range resp.Header["Link"] {
+		for _, m := range linkHeaderRe.FindAllStringSubmatch(link, -1) {
+			if hasRel(m[2], "webmention") {
+				return resolve(base, m[1])
+			}
+		}
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return "", nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxFetchSize))
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range relTagRe.FindAllString(string(body), -1) {
+		rel := relAttrRe.FindStringSubmatch(tag)
+		if rel == nil || !hasRel(rel[1], "webmention") {
+			continue
+		}
+		href := hrefAttrRe.FindStringSubmatch(tag)
+		if href == nil {
+			continue
+		}
+		// empty href is the target itself.
+		return resolve(base, html.UnescapeString(href[1]))
+	}
+	return "", nil
+}
+
+func hasRel(rels, rel string) bool {
+	for _, r := range strings.Fields(rels) {
+		if strings.EqualFold(r, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolve(base *url.URL, ref string) (string, error) {
+	u, err := base.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// lookupTarget finds the post for target, a url of the blog.
+func (b *Blogplus) lookupTarget(req *http.Request, target string) (Activity, bool) {
+	post, found := b.lookupPost(req, target)
+	if !found || post.Override.Hidden {
+		return Activity{}, false
+	}
+	return post, true
+}
+
+// lookupPost is like lookupTarget, but it also finds hidden posts.
+func (b *Blogplus) lookupPost(req *http.Request, target string) (Activity, bool) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host != getServerRoot(b, req).Host || !strings.HasPrefix(u.Path, b.Prefix+"/") {
+		return Activity{}, false
+	}
+	p := strings.TrimPrefix(u.Path, b.Prefix)
+	if m := slugPathRe.FindStringSubmatch(p); m != nil {
+		return b.storage.GetPostBySlug(req, m[1]+"-"+m[2], m[3])
+	}
+	if strings.HasPrefix(p, postPath) {
+		return b.storage.GetPost(req, strings.TrimPrefix(p, postPath))
+	}
+	return Activity{}, false
+}
+
+// ServeWebmention accepts Webmentions. The source is verified
+// asynchronously, and the mention is stored for moderation. Requests
+// are refused while too many mentions are being verified.
+func (b *Blogplus) ServeWebmention(w http.ResponseWriter, req *http.Request) {
+	if !b.Webmention {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	source := req.PostFormValue("source")
+	target := req.PostFormValue("target")
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "bad source", http.StatusBadRequest)
+		return
+	}
+	if source == target {
+		http.Error(w, "source is target", http.StatusBadRequest)
+		return
+	}
+	post, found := b.lookupTarget(req, target)
+	if !found {
+		http.Error(w, "unknown target", http.StatusBadRequest)
+		return
+	}
+	select {
+	case b.mentionVerifying <- struct{}{}:
+	default:
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many pending webmentions", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	go func() {
+		defer func() { <-b.mentionVerifying }()
+		b.verifyWebmention(source, target, post.Id)
+	}()
+}
+
+// verifyWebmention checks that source links to target, and stores or
+// deletes the mention. The page cache is flushed only if approved
+// mentions, which are shown in pages, change.
+func (b *Blogplus) verifyWebmention(source, target, postId string) {
+	var req *http.Request
+	var old *Mention
+	for _, m := range b.storage.GetMentions(req, postId) {
+		if m.Source == source {
+			m := m
+			old = &m
+		}
+	}
+	deleteMention := func() {
+		if old == nil {
+			return
+		}
+		b.storage.DeleteMention(req, source, postId)
+		if old.Approved {
+			b.cache.flush()
+		}
+	}
+	resp, err := webmentionClient.Get(source)
+	if err != nil {
+		log.Println("webmention verify:", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		deleteMention()
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		log.Println("webmention verify:", source, resp.Status)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxFetchSize))
+	if err != nil {
+		log.Println("webmention verify:", err)
+		return
+	}
+	body := string(data)
+	linked := false
+	for _, m := range hrefRe.FindAllStringSubmatch(body, -1) {
+		if html.UnescapeString(m[1]) == target {
+			linked = true
+			break
+		}
+	}
+	if !linked {
+		// the link may have been removed.
+		deleteMention()
+		return
+	}
+	mention := Mention{
+		Source:   source,
+		Target:   target,
+		PostId:   postId,
+		Received: time.Now().UTC().Format(time.RFC3339)}
+	if m := titleRe.FindStringSubmatch(body); m != nil {
+		mention.Title = truncateRunes(strings.TrimSpace(spacesRe.ReplaceAllString(html.UnescapeString(m[1]), " ")), maxMentionTitleLength)
+	}
+	if m := metaAuthorRe.FindStringSubmatch(body); m != nil {
+		mention.Author = html.UnescapeString(m[1])
+	}
+	if old != nil {
+		// updated mention keeps moderation.
+		mention.Approved = old.Approved
+	}
+	b.storage.StoreMention(req, mention)
+	if mention.Approved {
+		b.cache.flush()
+	}
+	log.Println("webmention received:", source, target)
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "…"
+}
+
+// approvedMentions returns the mentions of the post to show.
+func approvedMentions(mentions []Mention) []Mention {
+	var approved []Mention
+	for _, m := range mentions {
+		if m.Approved {
+			approved = append(approved, m)
+		}
+	}
+	return approved
+}
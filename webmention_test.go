@@ -0,0 +1,189 @@
+package blogplus
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	} {
+		if got := isPublicIP(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("isPublicIP(%s)=%t; want %t", tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestWebmentionClientRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("request to loopback: %s", req.URL)
+	}))
+	defer srv.Close()
+	resp, err := webmentionClient.Get(srv.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("webmentionClient.Get(%s) succeeded", srv.URL)
+	}
+	if !strings.Contains(err.Error(), "non-public address") {
+		t.Errorf("webmentionClient.Get(%s): %v", srv.URL, err)
+	}
+}
+
+// useTestWebmentionClient lets webmentionClient reach httptest servers
+// until the returned func is called.
+func useTestWebmentionClient() func() {
+	orig := webmentionClient
+	webmentionClient = &http.Client{Timeout: 5 * time.Second}
+	return func() { webmentionClient = orig }
+}
+
+func TestSendWebmentionsOnlyForChangedContent(t *testing.T) {
+	defer useTestWebmentionClient()()
+	var mu sync.Mutex
+	var received []string
+	ext := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/article":
+			w.Header().Set("Link", `</wm>; rel="webmention"`)
+		case "/wm":
+			mu.Lock()
+			received = append(received, req.PostFormValue("source"))
+			mu.Unlock()
+		}
+	}))
+	defer ext.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received)
+	}
+	b, s := newTestBlogplus()
+	b.Webmention = true
+
+	link := fmt.Sprintf(`See <a href="%s/article">this</a>.`, ext.URL)
+	post := testPost("wm1", time.Now(), link)
+	s.StorePosts(nil, []Activity{post})
+	waitFor(t, "webmention of the new post", func() bool { return count() == 1 })
+
+	s.StorePosts(nil, []Activity{post})
+	s.SetOverride(nil, "wm1", Override{Pinned: true})
+	s.SetOverride(nil, "wm1", Override{Pinned: true, Subject: "Subject"})
+	s.StorePosts(nil, []Activity{testPost("old1", time.Now().Add(-30*24*time.Hour), link)})
+	time.Sleep(200 * time.Millisecond)
+	if n := count(); n != 1 {
+		t.Errorf("%d webmentions sent for unchanged, overridden or old posts", n-1)
+	}
+
+	post.Updated = time.Now().Add(time.Second).UTC().Format(time.RFC3339)
+	s.StorePosts(nil, []Activity{post})
+	waitFor(t, "webmention of the updated post", func() bool { return count() == 2 })
+}
+
+func TestVerifyWebmention(t *testing.T) {
+	defer useTestWebmentionClient()()
+	b, s := newTestBlogplus()
+	b.Webmention = true
+	s.StorePosts(nil, []Activity{testPost("wm1", time.Date(2012, 5, 1, 0, 0, 0, 0, time.UTC), "Target post.")})
+	target := "http://example.com/post/wm1"
+	linked := true
+	var mu sync.Mutex
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><title>A reply</title></head><body>`)
+		if linked {
+			fmt.Fprintf(w, `<a href="%s">re</a>`, target)
+		}
+		fmt.Fprint(w, `</body></html>`)
+	}))
+	defer src.Close()
+	cached := func() bool {
+		b.cache.mu.Lock()
+		defer b.cache.mu.Unlock()
+		return len(b.cache.m) > 0
+	}
+	fillCache := func() {
+		b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil))
+		if !cached() {
+			t.Fatal("page is not cached")
+		}
+	}
+	mention := func() *httptest.ResponseRecorder {
+		form := url.Values{"source": {src.URL + "/reply"}, "target": {target}}
+		req := httptest.NewRequest("POST", "http://example.com/webmention", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, req)
+		return w
+	}
+	idle := func() bool { return len(b.mentionVerifying) == 0 }
+
+	fillCache()
+	if w := mention(); w.Code != http.StatusAccepted {
+		t.Fatalf("webmention: %d %s", w.Code, w.Body)
+	}
+	waitFor(t, "pending mention", func() bool { return len(s.GetPendingMentions(nil)) == 1 })
+	waitFor(t, "end of verification", idle)
+	if !cached() {
+		t.Error("pending mention flushed the page cache")
+	}
+	m := s.GetPendingMentions(nil)[0]
+	if m.Title != "A reply" || m.PostId != "wm1" {
+		t.Errorf("mention %+v", m)
+	}
+
+	m.Approved = true
+	s.StoreMention(nil, m)
+	fillCache()
+	mu.Lock()
+	linked = false
+	mu.Unlock()
+	mention()
+	waitFor(t, "deleted mention", func() bool { return len(s.GetMentions(nil, "wm1")) == 0 })
+	waitFor(t, "end of verification", idle)
+	if cached() {
+		t.Error("deleting an approved mention didn't flush the page cache")
+	}
+
+	fillCache()
+	mention()
+	time.Sleep(100 * time.Millisecond)
+	waitFor(t, "end of verification", idle)
+	if !cached() {
+		t.Error("unlinked source without mention flushed the page cache")
+	}
+
+	for i := 0; i < maxMentionVerifications; i++ {
+		b.mentionVerifying <- struct{}{}
+	}
+	if w := mention(); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("webmention with verifications in flight: %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,337 @@
+package blogplus
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSub: https://www.w3.org/TR/websub/
+
+const (
+	websubPath = "/websub"
+
+	defaultLeaseSeconds = 10 * 24 * 60 * 60
+	maxLeaseSeconds     = 30 * 24 * 60 * 60
+	maxSecretLength     = 200
+
+	// limits of the work of the built-in hub for subscribers.
+	maxVerifications = 8    // verification requests in flight
+	maxSubscriptions = 1000 // subscriptions per topic
+)
+
+// websubTopics are the feeds published to the hub, relative to b.Prefix.
+var websubTopics = []string{atomFeedPath, rssFeedPath, jsonFeedPath}
+
+type websubSubscription struct {
+	secret  string
+	expires time.Time
+}
+
+// websubHub is a minimal WebSub hub for the feeds of the blog.
+// Subscriptions are kept in memory, so subscribers need to subscribe
+// again after restart, as they do when their leases expire.
+type websubHub struct {
+	b      *Blogplus
+	client *http.Client
+
+	verifying  chan struct{} // semaphore of verifications
+	publishing sync.Mutex    // one distribution at a time
+
+	mu   sync.Mutex
+	subs map[string]map[string]websubSubscription // topic -> callback -> subscription
+}
+
+// EnableHub makes b act as its own WebSub hub at /websub,
+// unless b.Hub is set. Callbacks at internal addresses are refused,
+// since anyone can subscribe.
+func (b *Blogplus) EnableHub() {
+	b.hub = &websubHub{
+		b:         b,
+		client:    newPublicClient(),
+		verifying: make(chan struct{}, maxVerifications),
+		subs:      make(map[string]map[string]websubSubscription)}
+}
+
+// hubURL returns the url of the WebSub hub, or "" if there is no hub.
+func (b *Blogplus) hubURL(serverRoot *url.URL) string {
+	if b.Hub != "" {
+		return b.Hub
+	}
+	if b.hub != nil {
+		return serverRoot.String() + websubPath
+	}
+	return ""
+}
+
+// setHubLink sets Link header to advertise the hub for the feed at p.
+func (b *Blogplus) setHubLink(w http.ResponseWriter, req *http.Request, p string) {
+	serverRoot := getServerRoot(b, req)
+	hub := b.hubURL(serverRoot)
+	if hub == "" {
+		return
+	}
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, hub))
+	w.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="self"`, serverRoot, p))
+}
+
+// notifyHub is a StoreHook to notify the hub of the feeds,
+// if posts change the latest posts.
+func (b *Blogplus) notifyHub(req *http.Request, posts []Activity, reason StoreReason) {
+	if b.Hub == "" && b.hub == nil {
+		return
+	}
+	if !containsAny(b.storage.GetLatestPosts(req), posts) {
+		return
+	}
+	serverRoot := getServerRoot(b, req)
+	if serverRoot.Host == "" {
+		log.Println("websub: unknown host, not notified")
+		return
+	}
+	if b.Hub != "" {
+		go pingHub(b.Hub, serverRoot)
+		return
+	}
+	go b.hub.publish(serverRoot)
+}
+
+func containsAny(l, posts []Activity) bool {
+	for _, a := range l {
+		for _, post := range posts {
+			if a.Id == post.Id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pingHub tells the external hub that the feeds are updated.
+func pingHub(hub string, serverRoot *url.URL) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, p := range websubTopics {
+		resp, err := client.PostForm(hub, url.Values{
+			"hub.mode": {"publish"},
+			"hub.url":  {serverRoot.String() + p}})
+		if err != nil {
+			log.Println("websub publish:", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Println("websub publish:", hub, resp.Status)
+		}
+	}
+}
+
+// ServeWebSub serves subscription requests to the built-in hub.
+// Requests for topics other than the feeds of the blog are rejected
+// without verification, and so are requests while too many
+// verifications are in flight.
+func (b *Blogplus) ServeWebSub(w http.ResponseWriter, req *http.Request) {
+	if b.hub == nil || b.Hub != "" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mode := req.PostFormValue("hub.mode")
+	topic := req.PostFormValue("hub.topic")
+	callback := req.PostFormValue("hub.callback")
+	secret := req.PostFormValue("hub.secret")
+	if mode != "subscribe" && mode != "unsubscribe" {
+		http.Error(w, "unsupported hub.mode", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "bad hub.callback", http.StatusBadRequest)
+		return
+	}
+	if len(secret) >= maxSecretLength {
+		http.Error(w, "hub.secret too long", http.StatusBadRequest)
+		return
+	}
+	lease := defaultLeaseSeconds
+	if s := req.PostFormValue("hub.lease_seconds"); s != "" {
+		lease, err = strconv.Atoi(s)
+		if err != nil || lease <= 0 {
+			http.Error(w, "bad hub.lease_seconds", http.StatusBadRequest)
+			return
+		}
+		if lease > maxLeaseSeconds {
+			lease = maxLeaseSeconds
+		}
+	}
+	allowed := false
+	serverRoot := getServerRoot(b, req)
+	for _, p := range websubTopics {
+		if topic == serverRoot.String()+p {
+			allowed = true
+		}
+	}
+	if !allowed {
+		http.Error(w, "unknown hub.topic", http.StatusBadRequest)
+		return
+	}
+	if mode == "subscribe" && b.hub.full(topic, callback) {
+		http.Error(w, "too many subscriptions", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case b.hub.verifying <- struct{}{}:
+	default:
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many pending verifications", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	go func() {
+		defer func() { <-b.hub.verifying }()
+		b.hub.verify(mode, topic, callback, secret, lease)
+	}()
+}
+
+// full reports whether topic has no room for a new subscription of callback.
+func (h *websubHub) full(topic, callback string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, found := h.subs[topic][callback]
+	return !found && len(h.subs[topic]) >= maxSubscriptions
+}
+
+// verify verifies the intent of the subscriber, and then
+// updates the subscription.
+func (h *websubHub) verify(mode, topic, callback, secret string, lease int) {
+	q := url.Values{"hub.topic": {topic}}
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		log.Println("websub:", err)
+		return
+	}
+	challenge := hex.EncodeToString(buf[:])
+	q.Set("hub.mode", mode)
+	q.Set("hub.challenge", challenge)
+	if mode == "subscribe" {
+		q.Set("hub.lease_seconds", strconv.Itoa(lease))
+	}
+	resp, err := h.client.Get(withQuery(callback, q))
+	if err != nil {
+		log.Println("websub verify:", err)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	if err != nil || resp.StatusCode/100 != 2 || string(body) != challenge {
+		log.Println("websub verify failed:", callback, resp.Status)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if mode == "unsubscribe" {
+		delete(h.subs[topic], callback)
+		return
+	}
+	if h.subs[topic] == nil {
+		h.subs[topic] = make(map[string]websubSubscription)
+	}
+	h.subs[topic][callback] = websubSubscription{
+		secret:  secret,
+		expires: time.Now().Add(time.Duration(lease) * time.Second)}
+	log.Println("websub subscribed:", topic, callback)
+}
+
+func withQuery(u string, q url.Values) string {
+	if strings.Contains(u, "?") {
+		return u + "&" + q.Encode()
+	}
+	return u + "?" + q.Encode()
+}
+
+// publish distributes the current content of the feeds to the subscribers.
+func (h *websubHub) publish(serverRoot *url.URL) {
+	h.publishing.Lock()
+	defer h.publishing.Unlock()
+	hub := serverRoot.String() + websubPath
+	for _, p := range websubTopics {
+		topic := serverRoot.String() + p
+		subs := h.subscribers(topic)
+		if len(subs) == 0 {
+			continue
+		}
+		req := httptest.NewRequest("GET", topic, nil)
+		rec := httptest.NewRecorder()
+		h.b.route(rec, req)
+		if rec.Code != http.StatusOK {
+			log.Println("websub publish:", topic, rec.Code)
+			continue
+		}
+		body := rec.Body.Bytes()
+		for callback, sub := range subs {
+			dreq, err := http.NewRequest("POST", callback, bytes.NewReader(body))
+			if err != nil {
+				log.Println("websub distribute:", err)
+				continue
+			}
+			dreq.Header.Set("Content-Type", rec.Header().Get("Content-Type"))
+			dreq.Header.Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, hub))
+			dreq.Header.Add("Link", fmt.Sprintf(`<%s>; rel="self"`, topic))
+			if sub.secret != "" {
+				mac := hmac.New(sha256.New, []byte(sub.secret))
+				mac.Write(body)
+				dreq.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			}
+			resp, err := h.client.Do(dreq)
+			if err != nil {
+				log.Println("websub distribute:", err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusGone {
+				h.remove(topic, callback)
+			} else if resp.StatusCode/100 != 2 {
+				log.Println("websub distribute:", callback, resp.Status)
+			}
+		}
+	}
+}
+
+// subscribers returns the live subscriptions of topic,
+// dropping expired ones.
+func (h *websubHub) subscribers(topic string) map[string]websubSubscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs := make(map[string]websubSubscription)
+	now := time.Now()
+	for callback, sub := range h.subs[topic] {
+		if now.After(sub.expires) {
+			delete(h.subs[topic], callback)
+			continue
+		}
+		subs[callback] = sub
+	}
+	return subs
+}
+
+func (h *websubHub) remove(topic, callback string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[topic], callback)
+}
@@ -0,0 +1,207 @@
+package blogplus
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSubscriber is a WebSub subscriber that records requests from the hub.
+type testSubscriber struct {
+	*httptest.Server
+	// answer of verification; the challenge if empty.
+	answer string
+
+	mu          sync.Mutex
+	verified    []url.Values
+	distributed [][]byte
+	distHeader  http.Header
+}
+
+func newTestSubscriber() *testSubscriber {
+	s := &testSubscriber{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if req.Method == "GET" {
+			q := req.URL.Query()
+			s.verified = append(s.verified, q)
+			answer := s.answer
+			if answer == "" {
+				answer = q.Get("hub.challenge")
+			}
+			w.Write([]byte(answer))
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		s.distributed = append(s.distributed, body)
+		s.distHeader = req.Header
+	}))
+	return s
+}
+
+func (s *testSubscriber) counts() (verified, distributed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.verified), len(s.distributed)
+}
+
+func subscribe(b *Blogplus, mode, topic, callback string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"hub.mode":     {mode},
+		"hub.topic":    {topic},
+		"hub.callback": {callback},
+		"hub.secret":   {"s3cret"}}
+	req := httptest.NewRequest("POST", "http://example.com/websub", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, req)
+	return w
+}
+
+// enableTestHub enables the hub of b, which reaches httptest servers.
+func enableTestHub(b *Blogplus) {
+	b.EnableHub()
+	b.hub.client = &http.Client{Timeout: 5 * time.Second}
+}
+
+func TestWebSubSubscribeAndDistribute(t *testing.T) {
+	b, s := newTestBlogplus()
+	enableTestHub(b)
+	sub := newTestSubscriber()
+	defer sub.Close()
+
+	topic := "http://example.com/feed"
+	w := subscribe(b, "subscribe", topic, sub.URL+"/cb")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("subscribe: %d %s", w.Code, w.Body)
+	}
+	waitFor(t, "subscription", func() bool {
+		return len(b.hub.subscribers(topic)) == 1
+	})
+	sub.mu.Lock()
+	q := sub.verified[0]
+	sub.mu.Unlock()
+	if q.Get("hub.mode") != "subscribe" || q.Get("hub.topic") != topic || q.Get("hub.lease_seconds") == "" {
+		t.Errorf("verification query %v", q)
+	}
+
+	s.StorePosts(nil, []Activity{testPost("new1", time.Now(), "Brand new post.")})
+	waitFor(t, "distribution", func() bool {
+		_, n := sub.counts()
+		return n > 0
+	})
+	sub.mu.Lock()
+	body, h := sub.distributed[0], sub.distHeader
+	sub.mu.Unlock()
+	if !strings.Contains(string(body), "Brand new post.") {
+		t.Errorf("distributed body doesn't have the new post: %s", body)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if got, want := h.Get("X-Hub-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("X-Hub-Signature %q; want %q", got, want)
+	}
+	links := strings.Join(h["Link"], ", ")
+	if !strings.Contains(links, `<http://example.com/websub>; rel="hub"`) || !strings.Contains(links, `<`+topic+`>; rel="self"`) {
+		t.Errorf("Link %q", links)
+	}
+
+	w = subscribe(b, "unsubscribe", topic, sub.URL+"/cb")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("unsubscribe: %d %s", w.Code, w.Body)
+	}
+	waitFor(t, "unsubscription", func() bool {
+		return len(b.hub.subscribers(topic)) == 0
+	})
+}
+
+func TestWebSubRejectsUnknownTopic(t *testing.T) {
+	b, _ := newTestBlogplus()
+	enableTestHub(b)
+	sub := newTestSubscriber()
+	defer sub.Close()
+
+	for _, topic := range []string{"http://example.com/nope", "http://other.example.com/feed", ""} {
+		w := subscribe(b, "subscribe", topic, sub.URL+"/cb")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("subscribe %q: %d; want %d", topic, w.Code, http.StatusBadRequest)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n, _ := sub.counts(); n != 0 {
+		t.Errorf("callback was requested %d times for rejected topics", n)
+	}
+}
+
+func TestWebSubVerificationFailure(t *testing.T) {
+	b, _ := newTestBlogplus()
+	enableTestHub(b)
+	sub := newTestSubscriber()
+	sub.answer = "wrong"
+	defer sub.Close()
+
+	topic := "http://example.com/feed.rss"
+	w := subscribe(b, "subscribe", topic, sub.URL+"/cb")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("subscribe: %d %s", w.Code, w.Body)
+	}
+	waitFor(t, "verification", func() bool {
+		n, _ := sub.counts()
+		return n > 0
+	})
+	waitFor(t, "end of verification", func() bool {
+		return len(b.hub.verifying) == 0
+	})
+	if subs := b.hub.subscribers(topic); len(subs) != 0 {
+		t.Errorf("subscribed without the challenge: %v", subs)
+	}
+}
+
+func TestWebSubBoundsVerifications(t *testing.T) {
+	b, _ := newTestBlogplus()
+	enableTestHub(b)
+	sub := newTestSubscriber()
+	defer sub.Close()
+
+	for i := 0; i < maxVerifications; i++ {
+		b.hub.verifying <- struct{}{}
+	}
+	w := subscribe(b, "subscribe", "http://example.com/feed", sub.URL+"/cb")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("subscribe with verifications in flight: %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if n, _ := sub.counts(); n != 0 {
+		t.Errorf("callback was requested %d times", n)
+	}
+}
+
+func TestWebSubRefusesLoopbackCallback(t *testing.T) {
+	b, _ := newTestBlogplus()
+	b.EnableHub()
+	sub := newTestSubscriber()
+	defer sub.Close()
+
+	topic := "http://example.com/feed"
+	w := subscribe(b, "subscribe", topic, sub.URL+"/cb")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("subscribe: %d %s", w.Code, w.Body)
+	}
+	waitFor(t, "end of verification", func() bool {
+		return len(b.hub.verifying) == 0
+	})
+	if n, _ := sub.counts(); n != 0 {
+		t.Errorf("loopback callback was requested %d times", n)
+	}
+	if subs := b.hub.subscribers(topic); len(subs) != 0 {
+		t.Errorf("subscribed at loopback: %v", subs)
+	}
+}